@@ -0,0 +1,200 @@
+package buffman
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// apiKeyPrefix tells buffman keys apart from other secrets, e.g. in leak
+// scanners.
+const apiKeyPrefix = "bm_"
+
+// ErrApiKeyExists is returned when creating an API key under a name that is
+// already taken.
+var ErrApiKeyExists = errors.New("api key already exists")
+
+// ApiKey lets a caller queue requests for the listed destinations, or every
+// destination when none are listed. Only a hash of the key itself is stored.
+type ApiKey struct {
+	Id           int       `json:"id"`
+	Name         string    `json:"name"`
+	Destinations []string  `json:"destinations"`
+	CreatedOn    time.Time `json:"createdOn"`
+	RevokedOn    time.Time `json:"revokedOn"`
+}
+
+// Allows tells whether the key can queue requests for destination.
+func (k ApiKey) Allows(destination string) bool {
+	return len(k.Destinations) == 0 || slices.Contains(k.Destinations, destination)
+}
+
+// NewApiKey creates an API key and returns it along with the key to hand to
+// the caller, which can't be recovered afterwards.
+func NewApiKey(ctx context.Context, store Store, name string, destinations []string) (ApiKey, string, error) {
+	random := make([]byte, 32)
+
+	_, randErr := rand.Read(random)
+	if randErr != nil {
+		return ApiKey{}, "", randErr
+	}
+
+	secret := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	key, err := store.CreateApiKey(ctx, ApiKey{
+		Name:         name,
+		Destinations: destinations,
+		CreatedOn:    time.Now(),
+	}, hashApiKey(secret))
+
+	return key, secret, err
+}
+
+// AuthenticateApiKey returns the API key matching secret, ErrNotFound is
+// returned when there's none or it was revoked.
+func AuthenticateApiKey(ctx context.Context, store Store, secret string) (ApiKey, error) {
+	return store.FindApiKey(ctx, hashApiKey(secret))
+}
+
+func hashApiKey(secret string) string {
+	hashed := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hashed[:])
+}
+
+const apiKeyColumns = `id, name, destinations, createdOn, revokedOn`
+
+func scanApiKey(row scanner) (ApiKey, error) {
+	var (
+		key          ApiKey
+		destinations sql.NullString
+		revokedOn    sql.NullTime
+	)
+
+	scanErr := row.Scan(&key.Id, &key.Name, &destinations, &key.CreatedOn, &revokedOn)
+	if scanErr != nil {
+		return key, scanErr
+	}
+
+	key.RevokedOn = revokedOn.Time
+	key.Destinations = []string{}
+	if destinations.Valid {
+		destinationsErr := json.Unmarshal([]byte(destinations.String), &key.Destinations)
+		if destinationsErr != nil {
+			return key, destinationsErr
+		}
+	}
+
+	return key, nil
+}
+
+func (s *sqlStore) CreateApiKey(ctx context.Context, key ApiKey, keyHash string) (ApiKey, error) {
+	var destinations any
+	if len(key.Destinations) > 0 {
+		destinationsBytes, destinationsErr := json.Marshal(key.Destinations)
+		if destinationsErr != nil {
+			return key, destinationsErr
+		}
+		destinations = string(destinationsBytes)
+	}
+
+	tx, txErr := s.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return key, txErr
+	}
+	defer tx.Rollback()
+
+	var taken int
+
+	takenErr := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM ApiKeys WHERE name = @name`, s.args(sql.Named("name", key.Name))...).Scan(&taken)
+	if takenErr != nil {
+		return key, takenErr
+	} else if taken > 0 {
+		return key, ErrApiKeyExists
+	}
+
+	row := tx.QueryRowContext(
+		ctx,
+		`INSERT INTO ApiKeys (name, keyHash, destinations, createdOn)
+		VALUES (@name, @keyHash, @destinations, @createdOn)
+		RETURNING `+apiKeyColumns,
+		s.args(
+			sql.Named("name", key.Name),
+			sql.Named("keyHash", keyHash),
+			sql.Named("destinations", destinations),
+			sql.Named("createdOn", key.CreatedOn),
+		)...,
+	)
+
+	created, scanErr := scanApiKey(row)
+	if scanErr != nil {
+		return created, scanErr
+	}
+
+	return created, tx.Commit()
+}
+
+func (s *sqlStore) FindApiKey(ctx context.Context, keyHash string) (ApiKey, error) {
+	row := s.db.QueryRowContext(
+		ctx,
+		`SELECT `+apiKeyColumns+` FROM ApiKeys WHERE keyHash = @keyHash AND revokedOn IS NULL`,
+		s.args(sql.Named("keyHash", keyHash))...,
+	)
+
+	key, err := scanApiKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrNotFound
+	}
+
+	return key, err
+}
+
+func (s *sqlStore) ListApiKeys(ctx context.Context) ([]ApiKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM ApiKeys ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ApiKey{}
+
+	for rows.Next() {
+		key, scanErr := scanApiKey(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) RevokeApiKey(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE ApiKeys SET revokedOn = @revokedOn WHERE id = @id AND revokedOn IS NULL`,
+		s.args(
+			sql.Named("id", id),
+			sql.Named("revokedOn", time.Now()),
+		)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, affectedErr := res.RowsAffected()
+	if affectedErr != nil {
+		return affectedErr
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package buffman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// authenticator adds a destination's credentials to the requests dispatched to it.
+type authenticator interface {
+	authorize(req *http.Request)
+
+	// invalidate is called after the destination rejected the credentials
+	// sent with req, it reports whether renewed credentials are available.
+	invalidate(req *http.Request) bool
+}
+
+// newAuthenticator builds the authenticator selected by the destination's
+// auth config, token based ones log in right away and keep refreshing in the
+// background until ctx is done.
+func newAuthenticator(ctx context.Context, destination string, auth config.AuthConfig) (authenticator, error) {
+	switch auth.GetType() {
+	case config.AuthNone:
+		return noAuth{}, nil
+	case config.AuthFmaLogin:
+		return newTokenAuth(ctx, destination, fmaLoginFetcher(destination, auth))
+	case config.AuthBearer:
+		return bearerAuth{token: auth.Token}, nil
+	case config.AuthBasic:
+		return basicAuth{username: auth.Username, password: auth.Password}, nil
+	case config.AuthOAuth2:
+		return newTokenAuth(ctx, destination, oauth2Fetcher(destination, auth))
+	case config.AuthApiKey:
+		return apiKeyAuth{header: auth.Header, key: auth.Key}, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth type %s", auth.Type)
+}
+
+type noAuth struct{}
+
+func (noAuth) authorize(req *http.Request) {}
+
+func (noAuth) invalidate(req *http.Request) bool { return false }
+
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) authorize(req *http.Request) {
+	req.Header.Set("Authorization", fmt.Sprintf(`Bearer %s`, a.token))
+}
+
+func (bearerAuth) invalidate(req *http.Request) bool { return false }
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a basicAuth) authorize(req *http.Request) {
+	req.SetBasicAuth(a.username, a.password)
+}
+
+func (basicAuth) invalidate(req *http.Request) bool { return false }
+
+type apiKeyAuth struct {
+	header string
+	key    string
+}
+
+func (a apiKeyAuth) authorize(req *http.Request) {
+	req.Header.Set(a.header, a.key)
+}
+
+func (apiKeyAuth) invalidate(req *http.Request) bool { return false }
+
+// tokenAuth sends a token that is obtained by logging in and refreshed ahead
+// of its expiry, or right away when the destination rejects it.
+type tokenAuth struct {
+	tk *refreshingToken
+}
+
+func newTokenAuth(ctx context.Context, destination string, fetch tokenFetcher) (tokenAuth, error) {
+	tk, err := newRefreshingToken(ctx, destination, fetch)
+	if err != nil {
+		return tokenAuth{}, err
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		tk.waitAndRefresh()
+	}()
+
+	return tokenAuth{tk: tk}, nil
+}
+
+func (a tokenAuth) authorize(req *http.Request) {
+	req.Header.Set("Authorization", fmt.Sprintf(`Bearer %s`, a.tk.get()))
+}
+
+func (a tokenAuth) invalidate(req *http.Request) bool {
+	rejected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return a.tk.refreshIfStale(rejected)
+}
+
+// oauth2Fetcher obtains access tokens with the OAuth2 client credentials grant.
+func oauth2Fetcher(destination string, auth config.AuthConfig) tokenFetcher {
+	return func(ctx context.Context) (issuedToken, error) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if len(auth.Scopes) > 0 {
+			form.Set("scope", strings.Join(auth.Scopes, " "))
+		}
+
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, auth.TokenURL, strings.NewReader(form.Encode()))
+		if reqErr != nil {
+			return issuedToken{}, reqErr
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.ClientSecret))
+
+		start := time.Now()
+		res, resErr := http.DefaultClient.Do(req)
+		loginDuration.WithLabelValues(destination).Observe(time.Since(start).Seconds())
+
+		if resErr != nil {
+			return issuedToken{}, resErr
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return issuedToken{}, fmt.Errorf("received none 200 status code %v", res.StatusCode)
+		}
+
+		var responseBody struct {
+			AccessToken string  `json:"access_token"`
+			ExpiresIn   float64 `json:"expires_in"`
+		}
+		decodeErr := json.NewDecoder(res.Body).Decode(&responseBody)
+		if decodeErr != nil {
+			return issuedToken{}, fmt.Errorf("error while reading response body: %w", decodeErr)
+		} else if responseBody.AccessToken == "" {
+			return issuedToken{}, errors.New("token response did not contain an access_token")
+		}
+
+		return issuedToken{
+			value:     responseBody.AccessToken,
+			expiresAt: tokenExpiry(responseBody.AccessToken, responseBody.ExpiresIn),
+		}, nil
+	}
+}
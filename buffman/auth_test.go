@@ -0,0 +1,252 @@
+package buffman
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func authorizedHeaders(t *testing.T, auth config.AuthConfig) http.Header {
+	authCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	authn, err := newAuthenticator(authCtx, "test", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	authn.authorize(req)
+
+	return req.Header
+}
+
+func TestAuthenticators(t *testing.T) {
+	config.LoginInterval = time.Minute
+
+	t.Run("None", func(t *testing.T) {
+		headers := authorizedHeaders(t, config.AuthConfig{})
+
+		if len(headers) != 0 {
+			t.Errorf("expected no headers but got %v", headers)
+		}
+	})
+
+	t.Run("Bearer", func(t *testing.T) {
+		headers := authorizedHeaders(t, config.AuthConfig{Type: config.AuthBearer, Token: "static"})
+
+		if headers.Get("Authorization") != "Bearer static" {
+			t.Errorf("unexpected authorization header %s", headers.Get("Authorization"))
+		}
+	})
+
+	t.Run("Basic", func(t *testing.T) {
+		headers := authorizedHeaders(t, config.AuthConfig{Type: config.AuthBasic, Username: "admin", Password: "admin"})
+
+		if headers.Get("Authorization") != "Basic YWRtaW46YWRtaW4=" {
+			t.Errorf("unexpected authorization header %s", headers.Get("Authorization"))
+		}
+	})
+
+	t.Run("ApiKey", func(t *testing.T) {
+		headers := authorizedHeaders(t, config.AuthConfig{Type: config.AuthApiKey, Header: "X-Api-Key", Key: "k3y"})
+
+		if headers.Get("X-Api-Key") != "k3y" {
+			t.Errorf("unexpected api key header %s", headers.Get("X-Api-Key"))
+		}
+	})
+
+	t.Run("FmaLoginWithCustomTokenPath", func(t *testing.T) {
+		loginServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("x-tenant") != "acme" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{ "data": { "jwt": "LOGIN-token" } }`))
+		})
+
+		headers := authorizedHeaders(t, config.AuthConfig{
+			Type:         config.AuthFmaLogin,
+			LoginURL:     loginServer.URL,
+			LoginHeaders: map[string]string{"x-tenant": "acme"},
+			TokenPath:    "data.jwt",
+		})
+
+		if headers.Get("Authorization") != "Bearer LOGIN-token" {
+			t.Errorf("unexpected authorization header %s", headers.Get("Authorization"))
+		}
+	})
+
+	t.Run("OAuth2ClientCredentials", func(t *testing.T) {
+		tokenServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			clientID, clientSecret, _ := r.BasicAuth()
+			r.ParseForm()
+
+			if clientID != "buffman" || clientSecret != "s3cret" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "a b" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{ "access_token": "OAUTH-token", "token_type": "Bearer" }`))
+		})
+
+		headers := authorizedHeaders(t, config.AuthConfig{
+			Type:         config.AuthOAuth2,
+			TokenURL:     tokenServer.URL,
+			ClientID:     "buffman",
+			ClientSecret: "s3cret",
+			Scopes:       []string{"a", "b"},
+		})
+
+		if headers.Get("Authorization") != "Bearer OAUTH-token" {
+			t.Errorf("unexpected authorization header %s", headers.Get("Authorization"))
+		}
+	})
+
+	t.Run("OAuth2Rejected", func(t *testing.T) {
+		tokenServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+
+		_, err := newAuthenticator(ctx, "test", config.AuthConfig{
+			Type:     config.AuthOAuth2,
+			TokenURL: tokenServer.URL,
+			ClientID: "buffman",
+		})
+		if err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+}
+
+func TestRefreshIfStale(t *testing.T) {
+	var (
+		lock      sync.Mutex
+		refreshes = 0
+	)
+
+	tk, err := newRefreshingToken(ctx, "test", func(ctx context.Context) (issuedToken, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		refreshes++
+		time.Sleep(time.Millisecond * 10)
+
+		return issuedToken{value: fmt.Sprintf("token-%d", refreshes)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if !tk.refreshIfStale("token-1") {
+				t.Error("expected a renewed token to be available")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if refreshes != 2 {
+		t.Errorf("expected a single refresh after the initial login but got %d", refreshes-1)
+	}
+	if tk.get() != "token-2" {
+		t.Errorf("unexpected token %s", tk.get())
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	encodeJWT := func(claims string) string {
+		return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+
+	t.Run("JWTExpClaim", func(t *testing.T) {
+		expiry := jwtExpiry(encodeJWT(`{ "sub": "buffman", "exp": 1893456000 }`))
+
+		if !expiry.Equal(time.Unix(1893456000, 0)) {
+			t.Errorf("unexpected expiry %s", expiry)
+		}
+	})
+
+	t.Run("OpaqueToken", func(t *testing.T) {
+		if expiry := jwtExpiry("FMA-token"); !expiry.IsZero() {
+			t.Errorf("expected no expiry but got %s", expiry)
+		}
+		if expiry := jwtExpiry(encodeJWT(`{ "sub": "buffman" }`)); !expiry.IsZero() {
+			t.Errorf("expected no expiry but got %s", expiry)
+		}
+	})
+
+	t.Run("ExpiresInWinsOverJWT", func(t *testing.T) {
+		expiry := tokenExpiry(encodeJWT(`{ "exp": 1893456000 }`), 60)
+
+		if time.Until(expiry) > time.Minute || time.Until(expiry) < time.Second*59 {
+			t.Errorf("expected expiry to be a minute away but got %s", expiry)
+		}
+	})
+
+	t.Run("NextRefreshIn", func(t *testing.T) {
+		prevInterval := config.LoginInterval
+		config.LoginInterval = time.Minute * 30
+		t.Cleanup(func() { config.LoginInterval = prevInterval })
+
+		tk := refreshingToken{}
+		if delay := tk.nextRefreshIn(); delay != time.Minute*30 {
+			t.Errorf("expected unknown expiry to fall back to LOGIN_INTERVAL but got %s", delay)
+		}
+
+		tk.last.expiresAt = time.Now().Add(time.Hour)
+		if delay := tk.nextRefreshIn(); delay > time.Minute*59 || delay < time.Minute*58 {
+			t.Errorf("expected refresh a minute before expiry but got %s", delay)
+		}
+
+		tk.last.expiresAt = time.Now().Add(time.Second * 20)
+		if delay := tk.nextRefreshIn(); delay > time.Second*18 || delay < time.Second*17 {
+			t.Errorf("expected short lived token to be refreshed at 90%% of its lifetime but got %s", delay)
+		}
+
+		tk.last.expiresAt = time.Now().Add(-time.Hour)
+		if delay := tk.nextRefreshIn(); delay != minTokenRefreshDelay {
+			t.Errorf("expected expired token to be refreshed after %s but got %s", minTokenRefreshDelay, delay)
+		}
+
+		tk.lastErr = errors.New("login failed")
+		if delay := tk.nextRefreshIn(); delay != tokenRetryDelay {
+			t.Errorf("expected failed refresh to be retried after %s but got %s", tokenRetryDelay, delay)
+		}
+	})
+
+	t.Run("FmaLoginExpiresIn", func(t *testing.T) {
+		loginServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{ "result": { "token": "FMA-token", "expiresIn": 3600 } }`))
+		})
+
+		token, err := fetchApiTokenFromFma(ctx, "test", config.AuthConfig{LoginURL: loginServer.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token.value != "FMA-token" {
+			t.Errorf("unexpected token %s", token.value)
+		}
+		if time.Until(token.expiresAt) < time.Minute*59 {
+			t.Errorf("expected token to expire in an hour but got %s", token.expiresAt)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package buffman
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// nextBackoff returns how long a request that failed for the given number of
+// attempts should wait before it is dispatched again under the retry policy.
+func nextBackoff(retry config.RetryPolicy, attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(retry.BaseDelay.Duration) * math.Pow(retry.Multiplier, float64(attempts-1))
+
+	maxDelay := float64(retry.MaxDelay.Duration)
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if retry.Jitter > 0 {
+		delay += delay * retry.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,49 @@
+package buffman
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestNextBackoff(t *testing.T) {
+	retry := config.RetryPolicy{
+		BaseDelay:  config.Duration{Duration: time.Second},
+		Multiplier: 2,
+		MaxDelay:   config.Duration{Duration: time.Second * 10},
+	}
+
+	t.Run("Exponential", func(t *testing.T) {
+		expected := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8}
+
+		for i, exp := range expected {
+			delay := nextBackoff(retry, i+1)
+
+			if delay != exp {
+				t.Errorf("expected attempt %d to wait %s but got %s", i+1, exp, delay)
+			}
+		}
+	})
+
+	t.Run("Capped", func(t *testing.T) {
+		delay := nextBackoff(retry, 20)
+
+		if delay != time.Second*10 {
+			t.Errorf("expected delay to be capped at 10s but got %s", delay)
+		}
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		jittered := retry
+		jittered.Jitter = 0.5
+
+		for i := 0; i < 100; i++ {
+			delay := nextBackoff(jittered, 2)
+
+			if delay < time.Second || delay > time.Second*3 {
+				t.Fatalf("delay %s is outside of the jitter window", delay)
+			}
+		}
+	})
+}
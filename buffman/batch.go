@@ -0,0 +1,289 @@
+package buffman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// maxBatchResponseSize caps how much of a batch response is read to find the
+// result of its items.
+const maxBatchResponseSize = 10 << 20
+
+// itemResult is the outcome of a request sent as part of a batch.
+type itemResult struct {
+	status int
+	err    error
+}
+
+// dispatchBatches sends a group of requests in batches, one after the other.
+// Requests that failed within a batch that went through are retried on their
+// own schedule, the rest of the batch counts as delivered. Unless
+// config.ContinueOnError is set the group stops after the first batch with a
+// failure.
+func dispatchBatches(ctx context.Context, opts requestProcessingOpts, dest *destination, group []Request) int {
+	delivered := 0
+	attempted := 0
+
+	for _, batch := range splitBatches(group, dest.Batch) {
+		if until, ok := dest.available(); !ok {
+			holdRequests(ctx, opts, group[attempted:], until)
+			return delivered
+		}
+		if !extendLease(ctx, opts, group[attempted:]) {
+			releaseRequests(ctx, opts, group[attempted:])
+			return delivered
+		}
+		attempted += len(batch)
+
+		var (
+			results []itemResult
+			res     response
+		)
+		if len(batch) == 1 && !batchable(batch[0]) {
+			var err error
+			res, err = dispatchRequest(ctx, batch[0], dest)
+			results = []itemResult{{res.status, err}}
+		} else {
+			results, res = dispatchBatch(ctx, batch, dest)
+		}
+
+		failed := false
+
+		for i, req := range batch {
+			recordDelivery(ctx, opts, req, res, results[i].err)
+
+			if results[i].err != nil {
+				itemRes := response{status: results[i].status, headers: res.headers}
+				if !failRequest(ctx, opts, req, dest, itemRes, results[i].err) {
+					failed = true
+				}
+				continue
+			}
+
+			ackRequest(ctx, opts, req)
+			delivered++
+		}
+
+		if failed && !config.ContinueOnError {
+			log.Printf("stopping batched dispatch to %s for ordering key %q", dest.Name, batch[0].OrderingKey)
+			releaseRequests(ctx, opts, group[attempted:])
+			return delivered
+		}
+	}
+
+	return delivered
+}
+
+// batchable tells whether a request can be merged into a batch, only
+// uncompressed JSON payloads posted without a query, forwarded headers or an
+// idempotency key can since the batch call doesn't carry them.
+func batchable(req Request) bool {
+	return (req.Method == "" || req.Method == http.MethodPost) &&
+		req.Query == "" &&
+		len(req.Headers) == 0 &&
+		req.IdempotencyKey == "" &&
+		req.ContentEncoding == "" &&
+		json.Valid(req.Payload)
+}
+
+// splitBatches cuts a group of requests into batches of at most MaxItems
+// requests and MaxBytes of payloads, keeping their order. Requests that can't
+// be batched end up alone in theirs.
+func splitBatches(group []Request, cfg config.BatchConfig) [][]Request {
+	batches := [][]Request{}
+	current := []Request{}
+	size := 0
+
+	flush := func() {
+		if len(current) > 0 {
+			batches = append(batches, current)
+			current = []Request{}
+			size = 0
+		}
+	}
+
+	for _, req := range group {
+		if !batchable(req) {
+			flush()
+			batches = append(batches, []Request{req})
+			continue
+		}
+
+		if len(current) >= cfg.MaxItems || (cfg.MaxBytes > 0 && size+len(req.Payload) > cfg.MaxBytes) {
+			flush()
+		}
+
+		current = append(current, req)
+		size += len(req.Payload)
+	}
+	flush()
+
+	return batches
+}
+
+// encodeBatch merges the payloads of a batch into a JSON array, or one line
+// per payload for ndjson, and returns the body with its content type.
+func encodeBatch(batch []Request, format string) ([]byte, string, error) {
+	body := bytes.Buffer{}
+
+	if format == config.BatchNDJSON {
+		for _, req := range batch {
+			if err := json.Compact(&body, req.Payload); err != nil {
+				return nil, "", err
+			}
+			body.WriteByte('\n')
+		}
+
+		return body.Bytes(), "application/x-ndjson", nil
+	}
+
+	body.WriteByte('[')
+	for i, req := range batch {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		if err := json.Compact(&body, req.Payload); err != nil {
+			return nil, "", err
+		}
+	}
+	body.WriteByte(']')
+
+	return body.Bytes(), "application/json", nil
+}
+
+// dispatchBatch sends a batch in a single call and returns the result of each
+// of its requests, along with the response for the delivery log.
+func dispatchBatch(ctx context.Context, batch []Request, dest *destination) ([]itemResult, response) {
+	start := time.Now()
+
+	body, contentType, encodeErr := encodeBatch(batch, dest.Batch.GetFormat())
+	if encodeErr != nil {
+		return failBatch(batch, 0, encodeErr), response{}
+	}
+
+	res, err := sendWithRenewal(dest, func() (*http.Response, error) {
+		httpReq, httpReqErr := http.NewRequestWithContext(ctx, http.MethodPost, dest.URL, bytes.NewReader(body))
+		if httpReqErr != nil {
+			return nil, httpReqErr
+		}
+
+		httpReq.Header.Set("Content-Type", contentType)
+		for key, val := range dest.Headers {
+			httpReq.Header.Set(key, val)
+		}
+
+		return sendUpstream(dest, httpReq)
+	})
+	if err != nil {
+		failed := response{duration: time.Since(start)}
+		return failBatch(batch, 0, classifyAttempt(dest, failed, err)), failed
+	}
+	defer res.Body.Close()
+
+	// the results are read from the whole response, the delivery log only
+	// keeps its start
+	captured := readResponse(res, maxBatchResponseSize)
+	captured.duration = time.Since(start)
+
+	if classifyErr := classifyAttempt(dest, captured, nil); classifyErr != nil {
+		return failBatch(batch, res.StatusCode, classifyErr), captured
+	}
+
+	results := make([]itemResult, len(batch))
+	for i := range results {
+		results[i].status = res.StatusCode
+	}
+
+	if dest.Batch.ResultsPath == "" {
+		return results, captured
+	}
+
+	var doc any
+
+	decoder := json.NewDecoder(bytes.NewReader(captured.body))
+	decoder.UseNumber()
+
+	// without readable results there's no telling what went through, so
+	// the whole batch is retried
+	if decodeErr := decoder.Decode(&doc); decodeErr != nil {
+		return failBatch(batch, res.StatusCode, fmt.Errorf("error while reading batch results: %w", decodeErr)), captured
+	}
+
+	found, _ := lookupJSONPath(doc, dest.Batch.ResultsPath)
+	items, isArray := found.([]any)
+	if !isArray {
+		return failBatch(batch, res.StatusCode, fmt.Errorf("batch response has no results at %s", dest.Batch.ResultsPath)), captured
+	}
+
+	for i := range results {
+		if i >= len(items) {
+			results[i].err = fmt.Errorf("batch response has no result for item %d", i)
+			continue
+		}
+
+		results[i] = batchItemResult(items[i], dest, res.StatusCode)
+	}
+
+	return results, captured
+}
+
+// batchItemResult reads the result the upstream reported for an item, numeric
+// statuses are recorded as the item's status. The failure rules of dest are
+// matched against that status and the item itself, ahead of what the upstream
+// reported.
+func batchItemResult(item any, dest *destination, status int) itemResult {
+	itemStatus, _ := lookupJSONPath(item, dest.Batch.GetItemStatusPath())
+
+	succeeded := false
+	switch v := itemStatus.(type) {
+	case bool:
+		succeeded = v
+	case json.Number:
+		if code, err := v.Int64(); err == nil {
+			status = int(code)
+			succeeded = isSuccessStatus(status)
+		}
+	}
+
+	itemBody, _ := json.Marshal(item)
+	action, matched := matchingAction(dest.Failures, response{status: status, body: itemBody}, nil)
+	if !matched && succeeded {
+		action = config.FailureSuccess
+	}
+
+	var itemErr error
+	if succeeded {
+		itemErr = fmt.Errorf("batch item with status %d matched a failure rule", status)
+	} else {
+		reason := "no error given"
+		if found, ok := lookupJSONPath(item, dest.Batch.GetItemErrorPath()); ok {
+			reason = fmt.Sprint(found)
+		}
+		itemErr = fmt.Errorf("batch item failed with status %v: %s", itemStatus, reason)
+	}
+
+	switch action {
+	case config.FailureSuccess:
+		return itemResult{status: status}
+	case config.FailureDeadLetter:
+		return itemResult{status: status, err: fmt.Errorf("%w: %w", errPermanentFailure, itemErr)}
+	default:
+		return itemResult{status: status, err: itemErr}
+	}
+}
+
+func failBatch(batch []Request, status int, err error) []itemResult {
+	results := make([]itemResult, len(batch))
+	for i := range results {
+		results[i] = itemResult{status, err}
+	}
+
+	return results
+}
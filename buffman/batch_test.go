@@ -0,0 +1,212 @@
+package buffman
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestBatchedDelivery(t *testing.T) {
+	t.Run("splitting respects the item and byte limits", func(t *testing.T) {
+		group := []Request{
+			{Id: 1, Payload: []byte(`{"a":1}`)},
+			{Id: 2, Payload: []byte(`{"a":2}`)},
+			{Id: 3, Payload: []byte(`{"a":3}`)},
+			{Id: 4, Payload: []byte(`not json`)},
+			{Id: 5, Payload: []byte(`{"a":5,"padding":"xxxxxxxxxxxxxxxx"}`)},
+			{Id: 6, Payload: []byte(`{"a":6}`)},
+		}
+
+		batches := splitBatches(group, config.BatchConfig{MaxItems: 2, MaxBytes: 32})
+
+		got := [][]int{}
+		for _, batch := range batches {
+			got = append(got, requestIds(batch...))
+		}
+
+		expected := [][]int{{1, 2}, {3}, {4}, {5}, {6}}
+		if len(got) != len(expected) {
+			t.Fatalf("expected batches %v but got %v", expected, got)
+		}
+		for i := range expected {
+			if len(got[i]) != len(expected[i]) || got[i][0] != expected[i][0] {
+				t.Errorf("expected batches %v but got %v", expected, got)
+			}
+		}
+	})
+
+	t.Run("encoding as a JSON array or ndjson", func(t *testing.T) {
+		batch := []Request{
+			{Payload: []byte(`{ "a": 1 }`)},
+			{Payload: []byte("{\n\"a\": 2\n}")},
+		}
+
+		array, contentType, err := encodeBatch(batch, config.BatchJSON)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(array) != `[{"a":1},{"a":2}]` || contentType != "application/json" {
+			t.Errorf("unexpected JSON batch %s as %s", array, contentType)
+		}
+
+		lines, contentType, err := encodeBatch(batch, config.BatchNDJSON)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(lines) != "{\"a\":1}\n{\"a\":2}\n" || contentType != "application/x-ndjson" {
+			t.Errorf("unexpected ndjson batch %q as %s", lines, contentType)
+		}
+	})
+
+	t.Run("items the upstream rejected are retried on their own", func(t *testing.T) {
+		bodies := make(chan string, 1)
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			bodies <- string(body)
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"data":{"results":[{"status":201},{"status":422,"error":"invalid record"},{"status":true}]}}`))
+		})
+
+		store := createTestStore(t)
+		dest := &destination{
+			Destination: config.Destination{
+				Name:  "batched",
+				URL:   dispatchServer.URL,
+				Batch: config.BatchConfig{MaxItems: 10, ResultsPath: "data.results"},
+			},
+			auth: noAuth{},
+		}
+
+		for _, payload := range []string{`{"a":1}`, `{"a":2}`, `{"a":3}`} {
+			_, err := store.Enqueue(ctx, Request{Destination: "batched", Payload: []byte(payload), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		group := leaseAll(t, store)
+
+		delivered := dispatchBatches(ctx, requestProcessingOpts{store: store, owner: "tests"}, dest, group)
+		if delivered != 2 {
+			t.Errorf("expected 2 delivered requests but got %d", delivered)
+		}
+
+		if body := <-bodies; body != `[{"a":1},{"a":2},{"a":3}]` {
+			t.Errorf("expected the 3 payloads in a single call but got %s", body)
+		}
+
+		remaining, _, err := store.ListRequests(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(remaining) != 1 || remaining[0].Id != group[1].Id {
+			t.Fatalf("expected only the rejected request to be left but got %v", remaining)
+		}
+
+		if remaining[0].LastStatus != 422 || remaining[0].Attempts != 1 {
+			t.Errorf("expected the item status to be recorded but got %+v", remaining[0])
+		}
+	})
+
+	t.Run("requests that aren't plain posts are sent on their own", func(t *testing.T) {
+		calls := make(chan string, 3)
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			calls <- r.Method + " " + r.URL.RawQuery + " " + string(body)
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		store := createTestStore(t)
+		dest := &destination{
+			Destination: config.Destination{
+				Name:  "batched",
+				URL:   dispatchServer.URL,
+				Batch: config.BatchConfig{MaxItems: 10},
+			},
+			auth: noAuth{},
+		}
+
+		for _, req := range []Request{
+			{Payload: []byte(`{"a":1}`)},
+			{Method: http.MethodPut, Payload: []byte(`{"a":2}`)},
+			{Query: "b=3", Payload: []byte(`{"a":3}`)},
+		} {
+			req.Destination = "batched"
+			req.CreatedOn = time.Now()
+
+			_, err := store.Enqueue(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		delivered := dispatchBatches(ctx, requestProcessingOpts{store: store, owner: "tests"}, dest, leaseAll(t, store))
+		if delivered != 3 {
+			t.Errorf("expected 3 delivered requests but got %d", delivered)
+		}
+
+		close(calls)
+		got := []string{}
+		for call := range calls {
+			got = append(got, call)
+		}
+
+		expected := []string{`POST  [{"a":1}]`, `PUT  {"a":2}`, `POST b=3 {"a":3}`}
+		if !slices.Equal(got, expected) {
+			t.Errorf("expected %q but got %q", expected, got)
+		}
+	})
+
+	t.Run("failure rules apply to each item", func(t *testing.T) {
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"results":[{"status":201},{"status":422,"error":"invalid record"},{"status":409,"error":"already exists"},{"status":500}]}`))
+		})
+
+		store := createTestStore(t)
+		dest := &destination{
+			Destination: config.Destination{
+				Name:  "batched",
+				URL:   dispatchServer.URL,
+				Batch: config.BatchConfig{MaxItems: 10, ResultsPath: "results"},
+				Failures: []config.FailureRule{
+					{Status: config.StatusRange{Min: 422, Max: 422}, Action: config.FailureDeadLetter},
+					{Body: config.Pattern{Regexp: regexp.MustCompile("already exists")}, Action: config.FailureSuccess},
+				},
+			},
+			auth: noAuth{},
+		}
+
+		for _, payload := range []string{`{"a":1}`, `{"a":2}`, `{"a":3}`, `{"a":4}`} {
+			_, err := store.Enqueue(ctx, Request{Destination: "batched", Payload: []byte(payload), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		group := leaseAll(t, store)
+
+		delivered := dispatchBatches(ctx, requestProcessingOpts{store: store, owner: "tests"}, dest, group)
+		if delivered != 2 {
+			t.Errorf("expected the created and already existing items to be delivered but got %d", delivered)
+		}
+
+		letters, _, err := store.ListDeadLetters(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(letters) != 1 || letters[0].RequestId != group[1].Id {
+			t.Errorf("expected the invalid item to be dead lettered but got %+v", letters)
+		}
+
+		remaining, _, err := store.ListRequests(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(remaining) != 1 || remaining[0].Id != group[3].Id || remaining[0].LastStatus != 500 {
+			t.Errorf("expected the failed item to be retried but got %+v", remaining)
+		}
+	})
+}
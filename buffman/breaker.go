@@ -0,0 +1,196 @@
+package buffman
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// Circuit breaker states, see BreakerState.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerState is a snapshot of the circuit breaker of a destination.
+type BreakerState struct {
+	Destination string    `json:"destination"`
+	State       string    `json:"state"`
+	Failures    int       `json:"failures"`
+	OpenedAt    time.Time `json:"openedAt"`
+}
+
+var (
+	breakersLock = sync.Mutex{}
+	breakers     = map[string]*circuitBreaker{}
+)
+
+// BreakerStates returns the state of the circuit breaker of every destination
+// that has one, sorted by destination.
+func BreakerStates() []BreakerState {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	states := []BreakerState{}
+	for _, breaker := range breakers {
+		states = append(states, breaker.snapshot())
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Destination < states[j].Destination
+	})
+
+	return states
+}
+
+// circuitBreaker stops calls to a destination once threshold attempts in a row
+// failed. After coolDown a single probe is let through, which closes the
+// breaker when it succeeds and opens it again when it fails.
+type circuitBreaker struct {
+	lock sync.Mutex
+
+	destination string
+	threshold   int
+	coolDown    time.Duration
+
+	state    string
+	failures int
+	openedAt time.Time
+	probedAt time.Time
+}
+
+// newCircuitBreaker returns nil when the breaker of the destination is turned
+// off, a nil breaker lets every call through.
+func newCircuitBreaker(destination string, cfg config.BreakerConfig) *circuitBreaker {
+	cfg = cfg.Resolve()
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+
+	breakerState.WithLabelValues(destination).Set(0)
+
+	return &circuitBreaker{
+		destination: destination,
+		threshold:   cfg.FailureThreshold,
+		coolDown:    cfg.CoolDown.Duration,
+		state:       BreakerClosed,
+	}
+}
+
+// registerBreakers makes the breakers of the destinations being dispatched to
+// visible to BreakerStates.
+func registerBreakers(destinations map[string]*destination) {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	breakers = map[string]*circuitBreaker{}
+	for name, dest := range destinations {
+		if dest.breaker != nil {
+			breakers[name] = dest.breaker
+		}
+	}
+}
+
+// allow tells whether a call can be made to the destination.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		// a probe that never reported back doesn't hold the breaker forever
+		if now.Sub(b.probedAt) < b.coolDown {
+			return false
+		}
+	default:
+		return true
+	}
+
+	b.probedAt = now
+	return true
+}
+
+// probeAt returns when the breaker lets the next call through, the zero time
+// while it is closed.
+func (b *circuitBreaker) probeAt() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return b.openedAt.Add(b.coolDown)
+	case BreakerHalfOpen:
+		return b.probedAt.Add(b.coolDown)
+	}
+
+	return time.Time{}
+}
+
+// record counts the outcome of a call, only errors, 5xx and 429 responses
+// count as failures since any other answer means the destination is up.
+func (b *circuitBreaker) record(res *http.Response, err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	failed := err != nil || res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.transition(BreakerOpen)
+	}
+}
+
+func (b *circuitBreaker) transition(state string) {
+	log.Printf("circuit breaker of %s is now %s", b.destination, state)
+
+	b.state = state
+	breakerState.WithLabelValues(b.destination).Set(breakerStateValues[state])
+	breakerTransitions.WithLabelValues(b.destination, state).Inc()
+}
+
+func (b *circuitBreaker) snapshot() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return BreakerState{
+		Destination: b.destination,
+		State:       b.state,
+		Failures:    b.failures,
+		OpenedAt:    b.openedAt,
+	}
+}
@@ -0,0 +1,152 @@
+package buffman
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := &http.Response{StatusCode: http.StatusServiceUnavailable}
+	succeeding := &http.Response{StatusCode: http.StatusOK}
+
+	t.Run("opens after the threshold and probes once cooled down", func(t *testing.T) {
+		breaker := newCircuitBreaker("fma", config.BreakerConfig{FailureThreshold: 2, CoolDown: config.Duration{Duration: time.Millisecond * 50}})
+
+		breaker.record(failing, nil)
+		if !breaker.allow() {
+			t.Fatal("expected the breaker to stay closed under the threshold")
+		}
+
+		breaker.record(nil, errors.New("connection refused"))
+		if breaker.allow() || breaker.snapshot().State != BreakerOpen {
+			t.Fatalf("expected the breaker to open but got %+v", breaker.snapshot())
+		}
+
+		time.Sleep(time.Millisecond * 60)
+
+		if !breaker.allow() {
+			t.Fatal("expected a probe once the breaker cooled down")
+		} else if breaker.allow() {
+			t.Error("expected a single probe while half open")
+		}
+
+		breaker.record(failing, nil)
+		if breaker.allow() || breaker.snapshot().State != BreakerOpen {
+			t.Fatalf("expected a failed probe to open the breaker again but got %+v", breaker.snapshot())
+		}
+
+		time.Sleep(time.Millisecond * 60)
+
+		breaker.allow()
+		breaker.record(succeeding, nil)
+		if state := breaker.snapshot(); state.State != BreakerClosed || state.Failures != 0 {
+			t.Errorf("expected a successful probe to close the breaker but got %+v", state)
+		}
+	})
+
+	t.Run("client errors don't count as failures", func(t *testing.T) {
+		breaker := newCircuitBreaker("fma", config.BreakerConfig{FailureThreshold: 1, CoolDown: config.Duration{Duration: time.Minute}})
+
+		breaker.record(&http.Response{StatusCode: http.StatusBadRequest}, nil)
+		if !breaker.allow() {
+			t.Error("expected a 400 to keep the breaker closed")
+		}
+	})
+
+	t.Run("turned off with a negative threshold", func(t *testing.T) {
+		if breaker := newCircuitBreaker("fma", config.BreakerConfig{FailureThreshold: -1}); breaker != nil {
+			t.Errorf("expected no breaker but got %+v", breaker)
+		}
+	})
+
+	t.Run("an open breaker holds requests back without counting attempts", func(t *testing.T) {
+		calls := atomic.Int64{}
+		server := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		})
+
+		store := createTestStore(t)
+		dest := &destination{
+			Destination: config.Destination{Name: "fma", URL: server.URL},
+			auth:        noAuth{},
+			breaker:     newCircuitBreaker("fma", config.BreakerConfig{FailureThreshold: 1, CoolDown: config.Duration{Duration: time.Minute}}),
+		}
+		opts := requestProcessingOpts{store: store, owner: "tests", destinations: map[string]*destination{"fma": dest}}
+
+		for _, key := range []string{"a", "b"} {
+			_, err := store.Enqueue(ctx, Request{Destination: "fma", OrderingKey: key, Payload: []byte("{}"), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		leased, err := store.Lease(ctx, "tests", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, group := range groupByOrderingKey(leased) {
+			dispatchGroup(ctx, opts, group)
+		}
+
+		if calls.Load() != 1 {
+			t.Errorf("expected a single call before the breaker opened but got %d", calls.Load())
+		}
+
+		held, err := store.GetRequest(ctx, leased[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if held.Attempts != 0 || held.ClaimedBy != "" || held.NextAttemptAt.Before(time.Now().Add(time.Second*55)) {
+			t.Errorf("expected the held back request to wait for the breaker without using an attempt but got %+v", held)
+		}
+	})
+
+	t.Run("an open breaker doesn't hold back other destinations", func(t *testing.T) {
+		originalBatchSize := config.BatchSize
+		t.Cleanup(func() { config.BatchSize = originalBatchSize })
+		config.BatchSize = 2
+
+		calls := map[string]*atomic.Int64{"a": {}, "b": {}}
+		destinations := map[string]*destination{}
+
+		for name, count := range calls {
+			server := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				count.Add(1)
+			})
+
+			destinations[name] = &destination{
+				Destination: config.Destination{Name: name, URL: server.URL},
+				auth:        noAuth{},
+				breaker:     newCircuitBreaker(name, config.BreakerConfig{FailureThreshold: 1, CoolDown: config.Duration{Duration: time.Minute}}),
+			}
+		}
+		destinations["a"].breaker.record(nil, errors.New("connection refused"))
+
+		store := createTestStore(t)
+		opts := requestProcessingOpts{store: store, owner: "tests", destinations: destinations}
+
+		for _, req := range []Request{{Destination: "a", OrderingKey: "1"}, {Destination: "a", OrderingKey: "2"}, {Destination: "b"}} {
+			req.Payload = []byte("{}")
+			req.CreatedOn = time.Now()
+
+			_, err := store.Enqueue(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for range 3 {
+			dispatchBacklog(ctx, opts)
+		}
+
+		if calls["a"].Load() != 0 || calls["b"].Load() != 1 {
+			t.Errorf("expected only b to be called once but got %d calls to a and %d to b", calls["a"].Load(), calls["b"].Load())
+		}
+	})
+}
@@ -2,20 +2,67 @@ package buffman
 
 import (
 	"context"
-	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/mse99/buffman/config"
 )
 
-func StartDispatchToFMA(ctx context.Context, db *sql.DB) error {
-	tk, err := newFmaToken(ctx)
-	if err != nil {
-		return err
+// background tracks the goroutines StartDispatch leaves running, they all
+// return once its context is done.
+var background sync.WaitGroup
+
+// StartDispatch authenticates with every configured destination and starts dispatching
+// the backlog in the background.
+func StartDispatch(ctx context.Context, store Store) error {
+	adoptErr := store.AdoptUnassigned(ctx, config.GetDefaultDestination())
+	if adoptErr != nil {
+		return adoptErr
+	}
+
+	destinations := map[string]*destination{}
+
+	for _, dest := range config.GetDestinations() {
+		auth, err := newAuthenticator(ctx, dest.Name, dest.Auth)
+		if err != nil {
+			return fmt.Errorf("error while authenticating with %s: %w", dest.Name, err)
+		}
+
+		destinations[dest.Name] = &destination{
+			Destination: dest,
+			auth:        auth,
+			breaker:     newCircuitBreaker(dest.Name, dest.Breaker),
+			throttle:    newThrottle(dest.Name, dest.RateLimit),
+		}
 	}
-	go tk.waitAndRefresh()
+	registerBreakers(destinations)
+
+	background.Add(3)
+	go func() {
+		defer background.Done()
+
+		reencryptErr := store.Reencrypt(ctx)
+		if reencryptErr != nil {
+			log.Println("error while re-encrypting payloads", reencryptErr)
+		}
+	}()
+
+	go func() {
+		defer background.Done()
+
+		pruneDeliveryLogPeriodically(ctx, store)
+	}()
+
+	go func() {
+		defer background.Done()
 
-	go processStoredRequests(ctx, requestProcessingOpts{
-		db: db,
-		tk: tk,
-	})
+		processStoredRequests(ctx, requestProcessingOpts{
+			store:        store,
+			destinations: destinations,
+			owner:        config.InstanceId,
+		})
+	}()
 
 	return nil
 }
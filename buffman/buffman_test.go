@@ -1,12 +1,16 @@
 package buffman
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -23,7 +27,7 @@ func createTestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
 	return server
 }
 
-func createTestDB(t *testing.T) *sql.DB {
+func createTestStore(t *testing.T) *sqlStore {
 	db, err := repos.ConnectToDB(ctx, ":memory:")
 	if err != nil {
 		t.Fatal(err)
@@ -32,7 +36,19 @@ func createTestDB(t *testing.T) *sql.DB {
 		db.Close()
 	})
 
-	return db
+	return &sqlStore{db: db, dialect: sqliteDialect}
+}
+
+// startTestDispatch starts dispatching until the test ends, then waits for the
+// dispatcher to stop so it doesn't outlive the config the test set up.
+func startTestDispatch(t *testing.T, store Store) error {
+	dispatchCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(func() {
+		cancel()
+		background.Wait()
+	})
+
+	return StartDispatch(dispatchCtx, store)
 }
 
 func TestDispatching(t *testing.T) {
@@ -47,8 +63,8 @@ func TestDispatching(t *testing.T) {
 
 		config.FmaLoginURL = loginServer.URL
 
-		db := createTestDB(t)
-		err := StartDispatchToFMA(ctx, db)
+		store := createTestStore(t)
+		err := startTestDispatch(t, store)
 
 		if err == nil {
 			t.Error("expected error but got nil")
@@ -95,9 +111,9 @@ func TestDispatching(t *testing.T) {
 		config.FmaUsername = "admin"
 		config.FmaPassword = "admin"
 
-		db := createTestDB(t)
+		store := createTestStore(t)
 
-		err := StartDispatchToFMA(ctx, db)
+		err := startTestDispatch(t, store)
 		if err != nil {
 			t.Error(err)
 		}
@@ -160,14 +176,14 @@ func TestDispatching(t *testing.T) {
 		config.FmaUsername = "admin"
 		config.FmaPassword = "admin"
 
-		db := createTestDB(t)
+		store := createTestStore(t)
 
-		err := StartDispatchToFMA(ctx, db)
+		err := startTestDispatch(t, store)
 		if err != nil {
 			t.Error(err)
 		}
 
-		queueErr := QueueRequest(ctx, db, `{ "x_id": 123 }`)
+		queueErr := QueueRequest(ctx, store, Inbound{Destination: config.LegacyDestinationName, Payload: []byte(`{ "x_id": 123 }`)})
 		if queueErr != nil {
 			t.Error(queueErr)
 		}
@@ -181,7 +197,7 @@ func TestDispatching(t *testing.T) {
 			t.Errorf("unexpected payload %s", p1)
 		}
 
-		requests, loadErr := loadUnfinishedRequests(ctx, db)
+		requests, loadErr := store.Lease(ctx, "tests", 0, 0)
 		if loadErr != nil {
 			t.Error(loadErr)
 		} else if len(requests) != 0 {
@@ -235,14 +251,14 @@ func TestDispatching(t *testing.T) {
 		config.FmaUsername = "admin"
 		config.FmaPassword = "admin"
 
-		db := createTestDB(t)
+		store := createTestStore(t)
 
-		err := StartDispatchToFMA(ctx, db)
+		err := startTestDispatch(t, store)
 		if err != nil {
 			t.Error(err)
 		}
 
-		queueErr := QueueRequest(ctx, db, `{ "x_id": 123 }`)
+		queueErr := QueueRequest(ctx, store, Inbound{Destination: config.LegacyDestinationName, Payload: []byte(`{ "x_id": 123 }`)})
 		if queueErr != nil {
 			t.Error(queueErr)
 		}
@@ -262,7 +278,7 @@ func TestDispatching(t *testing.T) {
 			t.Errorf("unexpected payload %s", p2)
 		}
 
-		requests, loadErr := loadUnfinishedRequests(ctx, db)
+		requests, loadErr := store.Lease(ctx, "tests", 0, 0)
 		if loadErr != nil {
 			t.Error(loadErr)
 		} else if len(requests) != 1 {
@@ -319,31 +335,31 @@ func TestDispatching(t *testing.T) {
 		config.FmaUsername = "admin"
 		config.FmaPassword = "admin"
 
-		db := createTestDB(t)
+		store := createTestStore(t)
 
-		err := StartDispatchToFMA(ctx, db)
+		err := startTestDispatch(t, store)
 		if err != nil {
 			t.Error(err)
 		}
 
-		_, err1 := insertRequest(ctx, db, Request{
-			Payload:   "FOO",
+		_, err1 := store.Enqueue(ctx, Request{
+			Payload:   []byte("FOO"),
 			CreatedOn: time.Now().Add(-time.Second * 5),
 		})
 		if err1 != nil {
 			t.Error(err1)
 		}
 
-		_, err2 := insertRequest(ctx, db, Request{
-			Payload:   "BAR",
+		_, err2 := store.Enqueue(ctx, Request{
+			Payload:   []byte("BAR"),
 			CreatedOn: time.Now().Add(-time.Second * 3),
 		})
 		if err2 != nil {
 			t.Error(err2)
 		}
 
-		_, err3 := insertRequest(ctx, db, Request{
-			Payload:   "BAZ",
+		_, err3 := store.Enqueue(ctx, Request{
+			Payload:   []byte("BAZ"),
 			CreatedOn: time.Now().Add(-time.Second),
 		})
 		if err3 != nil {
@@ -358,7 +374,7 @@ func TestDispatching(t *testing.T) {
 			t.Errorf("invalid payloads order %v", payloads)
 		}
 
-		reqs, reqsErr := loadUnfinishedRequests(ctx, db)
+		reqs, reqsErr := store.Lease(ctx, "tests", 0, 0)
 		if reqsErr != nil {
 			t.Error(reqsErr)
 		}
@@ -366,4 +382,447 @@ func TestDispatching(t *testing.T) {
 			t.Error("requests were not removed from queue")
 		}
 	})
+
+	t.Run("ShouldDeadLetterAfterMaxAttempts", func(t *testing.T) {
+		config.MaxAttempts = 2
+		t.Cleanup(func() { config.MaxAttempts = 0 })
+
+		loginServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{ "result": { "token": "FMA-token" } }`))
+		})
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Down for maintenance"))
+		})
+
+		config.FmaDispatchURL = dispatchServer.URL
+		config.FmaLoginURL = loginServer.URL
+
+		store := createTestStore(t)
+
+		err := startTestDispatch(t, store)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, insertErr := store.Enqueue(ctx, Request{
+			Payload:   []byte("FOO"),
+			CreatedOn: time.Now(),
+		})
+		if insertErr != nil {
+			t.Error(insertErr)
+		}
+		time.Sleep(time.Millisecond * 350)
+
+		reqs, reqsErr := store.Lease(ctx, "tests", 0, 0)
+		if reqsErr != nil {
+			t.Error(reqsErr)
+		} else if len(reqs) != 0 {
+			t.Errorf("expected request to leave the backlog but found %v", reqs)
+		}
+
+		letters, lettersErr := loadDeadLetters(ctx, store)
+		if lettersErr != nil {
+			t.Fatal(lettersErr)
+		} else if len(letters) != 1 {
+			t.Fatalf("expected 1 dead letter but got %d", len(letters))
+		}
+
+		letter := letters[0]
+
+		if string(letter.Payload) != "FOO" {
+			t.Errorf("unexpected dead letter payload %s", letter.Payload)
+		}
+		if letter.Attempts != 2 {
+			t.Errorf("expected 2 attempts but got %d", letter.Attempts)
+		}
+		if letter.LastStatus != http.StatusServiceUnavailable {
+			t.Errorf("expected last status to be 503 but got %d", letter.LastStatus)
+		}
+		if letter.LastError == "" {
+			t.Error("expected last error to be recorded")
+		}
+	})
+
+	t.Run("ShouldReleaseRestOfGroupOnFailure", func(t *testing.T) {
+		calls := 0
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		store := createTestStore(t)
+		opts := requestProcessingOpts{
+			store: store,
+			owner: "tests",
+			destinations: map[string]*destination{
+				"fma": {Destination: config.Destination{Name: "fma", URL: dispatchServer.URL}, auth: noAuth{}},
+			},
+		}
+
+		for _, payload := range []string{"first", "second"} {
+			_, err := store.Enqueue(ctx, Request{Destination: "fma", OrderingKey: "order-1", Payload: []byte(payload), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		group := leaseAll(t, store)
+
+		if delivered := dispatchGroup(ctx, opts, group); delivered != 0 || calls != 1 {
+			t.Errorf("expected dispatch to stop at the first failure but got %d delivered in %d calls", delivered, calls)
+		}
+
+		second, err := store.GetRequest(ctx, group[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if second.ClaimedBy != "" || second.Attempts != 0 {
+			t.Errorf("expected the rest of the group to be released untouched but got %+v", second)
+		}
+	})
+
+	t.Run("ShouldExtendLeaseWhileDispatchingGroup", func(t *testing.T) {
+		originalLeaseDuration := config.LeaseDuration
+		t.Cleanup(func() { config.LeaseDuration = originalLeaseDuration })
+		config.LeaseDuration = time.Millisecond * 200
+
+		store := createTestStore(t)
+
+		calls := 0
+		takenOver := []Request{}
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			time.Sleep(time.Millisecond * 120)
+
+			// by the last request the lease taken for the group has expired
+			if calls == 3 {
+				leased, err := store.Lease(ctx, "other", time.Minute, 0)
+				if err != nil {
+					t.Error(err)
+				}
+				takenOver = leased
+			}
+		})
+
+		opts := requestProcessingOpts{
+			store: store,
+			owner: "tests",
+			destinations: map[string]*destination{
+				"fma": {Destination: config.Destination{Name: "fma", URL: dispatchServer.URL}, auth: noAuth{}},
+			},
+		}
+
+		for _, payload := range []string{"first", "second", "third"} {
+			_, err := store.Enqueue(ctx, Request{Destination: "fma", OrderingKey: "order-1", Payload: []byte(payload), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		group, err := store.Lease(ctx, "tests", config.LeaseDuration, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if delivered := dispatchGroup(ctx, opts, group); delivered != 3 {
+			t.Errorf("expected the whole group to be delivered but got %d", delivered)
+		}
+		if len(takenOver) != 0 {
+			t.Errorf("expected the rest of the group to stay leased but another owner got %v", requestIds(takenOver...))
+		}
+	})
+
+	t.Run("DispatchToNamedDestinations", func(t *testing.T) {
+		var (
+			lock     = sync.Mutex{}
+			payloads = map[string][]string{}
+		)
+
+		recordTo := func(name string) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+
+				payloadBytes, _ := io.ReadAll(r.Body)
+				payloads[name] = append(payloads[name], string(payloadBytes)+" "+r.Header.Get("X-Source"))
+
+				w.WriteHeader(http.StatusOK)
+			}
+		}
+
+		first := createTestServer(t, recordTo("first"))
+		second := createTestServer(t, recordTo("second"))
+
+		config.Destinations = []config.Destination{
+			{Name: "first", URL: first.URL, Headers: map[string]string{"X-Source": "buffman"}},
+			{Name: "second", URL: second.URL},
+		}
+		t.Cleanup(func() { config.Destinations = nil })
+
+		store := createTestStore(t)
+
+		err := startTestDispatch(t, store)
+		if err != nil {
+			t.Error(err)
+		}
+
+		queueErr := QueueRequest(ctx, store, Inbound{Destination: "second", Payload: []byte("FOO")})
+		if queueErr != nil {
+			t.Error(queueErr)
+		}
+
+		queueErr = QueueRequest(ctx, store, Inbound{Destination: "first", Payload: []byte("BAR")})
+		if queueErr != nil {
+			t.Error(queueErr)
+		}
+		time.Sleep(time.Millisecond * 150)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !reflect.DeepEqual(payloads["first"], []string{"BAR buffman"}) {
+			t.Errorf("unexpected payloads sent to first %v", payloads["first"])
+		}
+		if !reflect.DeepEqual(payloads["second"], []string{"FOO "}) {
+			t.Errorf("unexpected payloads sent to second %v", payloads["second"])
+		}
+	})
+
+	t.Run("DispatchConcurrentlyAcrossOrderingKeys", func(t *testing.T) {
+		config.Workers = 2
+		t.Cleanup(func() { config.Workers = 0 })
+
+		var (
+			lock     = sync.Mutex{}
+			received = []string{}
+		)
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			payloadBytes, _ := io.ReadAll(r.Body)
+			payload := string(payloadBytes)
+
+			lock.Lock()
+			received = append(received, payload)
+			lock.Unlock()
+
+			if strings.Contains(payload, `"seq":1`) && strings.Contains(payload, `"id":"a"`) {
+				time.Sleep(time.Millisecond * 100)
+			}
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		config.Destinations = []config.Destination{
+			{Name: "ordered", URL: dispatchServer.URL, OrderingKey: config.OrderingKeyConfig{JSONPath: "id"}},
+		}
+		t.Cleanup(func() { config.Destinations = nil })
+
+		store := createTestStore(t)
+
+		for _, payload := range []string{
+			`{"id":"a","seq":1}`,
+			`{"id":"b","seq":1}`,
+			`{"id":"a","seq":2}`,
+			`{"id":"b","seq":2}`,
+		} {
+			queueCtx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+			queueErr := QueueRequest(queueCtx, store, Inbound{Destination: "ordered", Payload: []byte(payload)})
+			cancel()
+			if queueErr != nil {
+				t.Error(queueErr)
+			}
+		}
+
+		err := startTestDispatch(t, store)
+		if err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond * 250)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if len(received) != 4 {
+			t.Fatalf("expected 4 dispatched requests but got %v", received)
+		}
+
+		if received[3] != `{"id":"a","seq":2}` {
+			t.Errorf("expected the slow ordering key to finish last but got %v", received)
+		}
+
+		if slices.Index(received, `{"id":"b","seq":1}`) > slices.Index(received, `{"id":"b","seq":2}`) {
+			t.Errorf("expected requests sharing an ordering key to be sent in order but got %v", received)
+		}
+	})
+
+	t.Run("DispatchBacklogInBatches", func(t *testing.T) {
+		received := make(chan string, 5)
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			received <- string(body)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		config.Destinations = []config.Destination{{Name: "batched", URL: dispatchServer.URL}}
+		t.Cleanup(func() { config.Destinations = nil })
+
+		config.BatchSize = 2
+		t.Cleanup(func() { config.BatchSize = 0 })
+
+		store := createTestStore(t)
+
+		for i := range 5 {
+			_, queueErr := store.Enqueue(ctx, Request{
+				Destination: "batched",
+				Payload:     []byte(strconv.Itoa(i)),
+				CreatedOn:   time.Now(),
+			})
+			if queueErr != nil {
+				t.Error(queueErr)
+			}
+		}
+
+		err := startTestDispatch(t, store)
+		if err != nil {
+			t.Error(err)
+		}
+
+		// a single poll goes through every batch
+		time.Sleep(time.Millisecond * 150)
+
+		if len(received) != 5 {
+			t.Fatalf("expected the whole backlog to be dispatched in one poll but got %d requests", len(received))
+		}
+
+		for i := range 5 {
+			if payload := <-received; payload != strconv.Itoa(i) {
+				t.Errorf("expected request %d to be dispatched in order but got %s", i, payload)
+			}
+		}
+	})
+
+	t.Run("ReplayOriginalRequest", func(t *testing.T) {
+		replayed := make(chan *http.Request, 1)
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			replayed <- r
+			w.WriteHeader(http.StatusOK)
+		})
+
+		config.Destinations = []config.Destination{
+			{Name: "erp", URL: dispatchServer.URL + "?source=buffman", ForwardHeaders: []string{"x-odoo-model"}},
+		}
+		t.Cleanup(func() { config.Destinations = nil })
+
+		store := createTestStore(t)
+
+		err := startTestDispatch(t, store)
+		if err != nil {
+			t.Error(err)
+		}
+
+		queueErr := QueueRequest(ctx, store, Inbound{
+			Destination: "erp",
+			Method:      http.MethodPut,
+			Payload:     []byte("id=1"),
+			Headers:     http.Header{"X-Odoo-Model": {"res.partner"}, "X-Secret": {"do not forward"}},
+			Query:       "id=1",
+			ContentType: "application/x-www-form-urlencoded",
+		})
+		if queueErr != nil {
+			t.Error(queueErr)
+		}
+
+		select {
+		case r := <-replayed:
+			if r.Method != http.MethodPut {
+				t.Errorf("expected method PUT but got %s", r.Method)
+			}
+			if r.URL.RawQuery != "source=buffman&id=1" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+				t.Errorf("unexpected content type %s", r.Header.Get("Content-Type"))
+			}
+			if r.Header.Get("X-Odoo-Model") != "res.partner" {
+				t.Errorf("expected X-Odoo-Model to be forwarded but got %q", r.Header.Get("X-Odoo-Model"))
+			}
+			if r.Header.Get("X-Secret") != "" {
+				t.Error("expected headers outside of the allow list to be dropped")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("request was not dispatched")
+		}
+	})
+
+	t.Run("ShouldRefreshTokenWhenRejected", func(t *testing.T) {
+		config.LoginInterval = time.Minute
+		t.Cleanup(func() { config.LoginInterval = time.Millisecond * 100 })
+
+		var (
+			lock       = sync.Mutex{}
+			loginCount = 0
+			payloads   = []string{}
+		)
+
+		loginServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			loginCount++
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(fmt.Sprintf(`{ "result": { "token": "FMA-token-%d" } }`, loginCount)))
+		})
+
+		dispatchServer := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if r.Header.Get("Authorization") != "Bearer FMA-token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			payloadBytes, _ := io.ReadAll(r.Body)
+			payloads = append(payloads, string(payloadBytes))
+
+			w.WriteHeader(http.StatusOK)
+		})
+
+		config.FmaDispatchURL = dispatchServer.URL
+		config.FmaLoginURL = loginServer.URL
+
+		store := createTestStore(t)
+
+		err := startTestDispatch(t, store)
+		if err != nil {
+			t.Error(err)
+		}
+
+		queueErr := QueueRequest(ctx, store, Inbound{Destination: config.LegacyDestinationName, Payload: []byte("FOO")})
+		if queueErr != nil {
+			t.Error(queueErr)
+		}
+		time.Sleep(time.Millisecond * 150)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !reflect.DeepEqual(payloads, []string{"FOO"}) {
+			t.Errorf("expected request to be delivered with the renewed token but got %v", payloads)
+		}
+		if loginCount != 2 {
+			t.Errorf("expected login count to be 2 but got %d", loginCount)
+		}
+
+		reqs, reqsErr := store.Lease(ctx, "tests", 0, 0)
+		if reqsErr != nil {
+			t.Error(reqsErr)
+		} else if len(reqs) != 0 || len(payloads) != 1 {
+			t.Error("request was not removed from queue")
+		}
+	})
 }
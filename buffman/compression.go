@@ -0,0 +1,75 @@
+package buffman
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mse99/buffman/config"
+)
+
+// zstd encoders and decoders are safe for concurrent use through EncodeAll
+// and DecodeAll, so a single one of each is shared.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// compressPayload compresses payloads of at least config.CompressionThreshold
+// bytes with config.PayloadCompression, it returns the compression that was
+// applied or an empty string when the payload is better stored as is.
+func compressPayload(payload []byte) ([]byte, string, error) {
+	if len(payload) < config.CompressionThreshold {
+		return payload, "", nil
+	}
+
+	var compressed []byte
+
+	switch config.PayloadCompression {
+	case config.CompressionGzip:
+		buf := bytes.Buffer{}
+
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(payload); err != nil {
+			return nil, "", err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, "", err
+		}
+
+		compressed = buf.Bytes()
+	case config.CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(payload, nil)
+	default:
+		return payload, "", nil
+	}
+
+	if len(compressed) >= len(payload) {
+		return payload, "", nil
+	}
+
+	return compressed, config.PayloadCompression, nil
+}
+
+// decompressPayload reverses compressPayload, rows stored before compression
+// was enabled have no compression and are returned untouched.
+func decompressPayload(payload []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "":
+		return payload, nil
+	case config.CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return io.ReadAll(reader)
+	case config.CompressionZstd:
+		return zstdDecoder.DecodeAll(payload, nil)
+	}
+
+	return nil, fmt.Errorf("unknown payload compression %s", compression)
+}
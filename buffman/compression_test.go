@@ -0,0 +1,84 @@
+package buffman
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestPayloadCompression(t *testing.T) {
+	t.Cleanup(func() {
+		config.PayloadCompression = ""
+		config.CompressionThreshold = 0
+	})
+
+	payload := []byte(strings.Repeat(`{ "x_id": 123 }`, 100))
+
+	for _, compression := range []string{config.CompressionGzip, config.CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			config.PayloadCompression = compression
+			config.CompressionThreshold = 64
+
+			compressed, applied, err := compressPayload(payload)
+			if err != nil {
+				t.Fatal(err)
+			} else if applied != compression || len(compressed) >= len(payload) {
+				t.Fatalf("expected the payload to be compressed with %s but got %s", compression, applied)
+			}
+
+			decompressed, decompressErr := decompressPayload(compressed, applied)
+			if decompressErr != nil {
+				t.Fatal(decompressErr)
+			} else if !bytes.Equal(decompressed, payload) {
+				t.Errorf("expected the payload to survive a round trip but got %s", decompressed)
+			}
+
+			small, smallApplied, smallErr := compressPayload([]byte("tiny"))
+			if smallErr != nil || smallApplied != "" || string(small) != "tiny" {
+				t.Errorf("expected payloads under the threshold to be stored as is but got %s %q", smallApplied, small)
+			}
+		})
+	}
+
+	t.Run("mixed rows", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		config.PayloadCompression = config.CompressionNone
+		_, err := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.PayloadCompression = config.CompressionZstd
+		config.CompressionThreshold = 64
+		compressed, err := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var storedSize int
+		sizeErr := store.db.QueryRowContext(ctx, `SELECT length(payload) FROM RequestsBacklog WHERE id = @id`, sql.Named("id", compressed.Id)).Scan(&storedSize)
+		if sizeErr != nil {
+			t.Fatal(sizeErr)
+		} else if storedSize >= len(payload) {
+			t.Errorf("expected the stored payload to be compressed but it is %d bytes", storedSize)
+		}
+
+		requests, loadErr := store.Lease(ctx, "tests", 0, 0)
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		} else if len(requests) != 2 {
+			t.Fatalf("expected 2 requests but got %d", len(requests))
+		}
+
+		for _, req := range requests {
+			if !bytes.Equal(req.Payload, payload) {
+				t.Errorf("unexpected payload for request %d", req.Id)
+			}
+		}
+	})
+}
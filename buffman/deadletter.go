@@ -0,0 +1,285 @@
+package buffman
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// DeadLetter is a request that exhausted its attempts, kept around together
+// with the reason of its last failure so it can be inspected or replayed.
+type DeadLetter struct {
+	Id          int       `json:"id"`
+	RequestId   int       `json:"requestId"`
+	Destination string    `json:"destination"`
+	Payload     []byte    `json:"payload"`
+	CreatedOn   time.Time `json:"createdOn"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	LastStatus  int       `json:"lastStatus"`
+	FailedOn    time.Time `json:"failedOn"`
+	ApiKey      string    `json:"apiKey"`
+}
+
+const deadLetterColumns = `id, requestId, destination, compression, keyId, wrappedKey, payload, createdOn, attempts, lastError, lastStatus, failedOn, apiKey`
+
+func scanDeadLetter(row scanner) (DeadLetter, error) {
+	var (
+		letter      DeadLetter
+		destination sql.NullString
+		compression sql.NullString
+		keyId       sql.NullString
+		stored      storedPayload
+		apiKey      sql.NullString
+	)
+
+	scanErr := row.Scan(
+		&letter.Id,
+		&letter.RequestId,
+		&destination,
+		&compression,
+		&keyId,
+		&stored.wrappedKey,
+		&stored.data,
+		&letter.CreatedOn,
+		&letter.Attempts,
+		&letter.LastError,
+		&letter.LastStatus,
+		&letter.FailedOn,
+		&apiKey,
+	)
+
+	if scanErr != nil {
+		return letter, scanErr
+	}
+
+	letter.Destination = destination.String
+	letter.ApiKey = apiKey.String
+	if letter.Destination == "" {
+		letter.Destination = config.GetDefaultDestination()
+	}
+
+	stored.compression = compression.String
+	stored.keyId = keyId.String
+
+	payload, unpackErr := stored.unpack()
+	if unpackErr != nil {
+		return letter, fmt.Errorf("dead letter %d: %w", letter.Id, unpackErr)
+	}
+	letter.Payload = payload
+
+	return letter, nil
+}
+
+func (s *sqlStore) DeadLetter(ctx context.Context, owner string, id int, lastStatus int, lastErr error) error {
+	tx, txErr := s.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	res, updateErr := tx.ExecContext(
+		ctx,
+		`UPDATE RequestsBacklog SET attempts = attempts + 1, lastError = @lastError, lastStatus = @lastStatus
+		WHERE id = @id AND claimedBy = @owner`,
+		s.args(
+			sql.Named("id", id),
+			sql.Named("owner", owner),
+			sql.Named("lastError", lastErr.Error()),
+			sql.Named("lastStatus", lastStatus),
+		)...,
+	)
+	if updateErr != nil {
+		return updateErr
+	}
+
+	leasedErr := expectLeased(res)
+	if leasedErr != nil {
+		return leasedErr
+	}
+
+	moveErr := s.moveToDeadLetters(ctx, tx, id)
+	if moveErr != nil {
+		return moveErr
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) MoveToDeadLetters(ctx context.Context, id int) error {
+	tx, txErr := s.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	var leaseUntil sql.NullTime
+
+	row := tx.QueryRowContext(ctx, `SELECT leaseUntil FROM RequestsBacklog WHERE id = @id `+s.dialect.lockRow, s.args(sql.Named("id", id))...)
+	scanErr := row.Scan(&leaseUntil)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if scanErr != nil {
+		return scanErr
+	} else if leaseUntil.Valid && leaseUntil.Time.After(time.Now()) {
+		return ErrLeased
+	}
+
+	moveErr := s.moveToDeadLetters(ctx, tx, id)
+	if moveErr != nil {
+		return moveErr
+	}
+
+	return tx.Commit()
+}
+
+// moveToDeadLetters copies a request to the dead letters as it is in tx and
+// removes it from the backlog.
+func (s *sqlStore) moveToDeadLetters(ctx context.Context, tx *sql.Tx, id int) error {
+	_, insertErr := tx.ExecContext(
+		ctx,
+		`INSERT INTO DeadLetters (requestId, destination, orderingKey, idempotencyKey, method, headers, query, contentType, contentEncoding, compression, keyId, wrappedKey, payload, createdOn, attempts, lastError, lastStatus, failedOn, apiKey)
+		SELECT id, destination, orderingKey, idempotencyKey, method, headers, query, contentType, contentEncoding, compression, keyId, wrappedKey, payload, createdOn, attempts, COALESCE(lastError, ''), COALESCE(lastStatus, 0), `+s.dialect.failedOn+`, apiKey FROM RequestsBacklog WHERE id = @id`,
+		s.args(
+			sql.Named("id", id),
+			sql.Named("failedOn", time.Now()),
+		)...,
+	)
+	if insertErr != nil {
+		return insertErr
+	}
+
+	res, deleteErr := tx.ExecContext(ctx, `DELETE FROM RequestsBacklog WHERE id = @id`, s.args(sql.Named("id", id))...)
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	return expectAffected(res)
+}
+
+// DeadLetterRequest moves a queued request to the dead letters on an operator's
+// request, such as one whose payload can no longer be decrypted. ErrLeased is
+// returned while an instance is dispatching it.
+func DeadLetterRequest(ctx context.Context, store Store, id int) error {
+	req, getErr := store.GetRequest(ctx, id)
+	if getErr != nil {
+		return getErr
+	}
+
+	err := store.MoveToDeadLetters(ctx, id)
+	if err != nil {
+		return err
+	}
+	requestsDropped.WithLabelValues(req.Destination).Inc()
+
+	return nil
+}
+
+func loadDeadLetters(ctx context.Context, store Store) ([]DeadLetter, error) {
+	letters, _, err := store.ListDeadLetters(ctx, ListOptions{})
+	return letters, err
+}
+
+// ListDeadLetters returns a page of the dead letters matching opts, in the
+// order they failed, along with the total number of matching dead letters.
+func (s *sqlStore) ListDeadLetters(ctx context.Context, opts ListOptions) ([]DeadLetter, int, error) {
+	var total int
+
+	countErr := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM DeadLetters WHERE `+s.dialect.listFilter, s.args(opts.args()...)...).Scan(&total)
+	if countErr != nil {
+		return nil, 0, countErr
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT `+deadLetterColumns+` FROM DeadLetters WHERE `+s.dialect.listFilter+` ORDER BY failedOn ASC `+s.dialect.limit+` OFFSET @offset`,
+		s.args(opts.args()...)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []DeadLetter{}
+
+	for rows.Next() {
+		// undecryptable payloads are left empty, the rest of the letter
+		// still tells what happened to it
+		letter, scanErr := scanDeadLetter(rows)
+		if scanErr != nil && !errors.Is(scanErr, ErrUndecryptable) {
+			return nil, 0, scanErr
+		}
+
+		results = append(results, letter)
+	}
+
+	return results, total, nil
+}
+
+func (s *sqlStore) GetDeadLetter(ctx context.Context, id int) (DeadLetter, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+deadLetterColumns+` FROM DeadLetters WHERE id = @id`, s.args(sql.Named("id", id))...)
+
+	letter, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return letter, ErrNotFound
+	} else if errors.Is(err, ErrUndecryptable) {
+		return letter, nil
+	}
+
+	return letter, err
+}
+
+func (s *sqlStore) Requeue(ctx context.Context, id int) (Request, error) {
+	tx, txErr := s.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return Request{}, txErr
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(
+		ctx,
+		`INSERT INTO RequestsBacklog (destination, orderingKey, idempotencyKey, method, headers, query, contentType, contentEncoding, compression, keyId, wrappedKey, payload, createdOn, attempts, apiKey)
+		SELECT destination, orderingKey, idempotencyKey, method, headers, query, contentType, contentEncoding, compression, keyId, wrappedKey, payload, createdOn, 0, apiKey FROM DeadLetters WHERE id = @id
+		RETURNING `+requestColumns,
+		s.args(sql.Named("id", id))...,
+	)
+
+	req, scanErr := scanRequest(row)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return req, ErrNotFound
+	} else if scanErr != nil {
+		return req, scanErr
+	}
+
+	_, deleteErr := tx.ExecContext(ctx, `DELETE FROM DeadLetters WHERE id = @id`, s.args(sql.Named("id", id))...)
+	if deleteErr != nil {
+		return req, deleteErr
+	}
+
+	return req, tx.Commit()
+}
+
+// RequeueDeadLetter moves a dead letter back into the backlog and wakes up the
+// dispatcher.
+func RequeueDeadLetter(ctx context.Context, store Store, id int) (Request, error) {
+	req, err := store.Requeue(ctx, id)
+	if err != nil {
+		return req, err
+	}
+
+	signalProcessing(ctx)
+	return req, nil
+}
+
+func (s *sqlStore) DeleteDeadLetter(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM DeadLetters WHERE id = @id`, s.args(sql.Named("id", id))...)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
@@ -0,0 +1,246 @@
+package buffman
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// Delivery is the receipt of an attempt to deliver a request, with what the
+// upstream answered. Body is cut to config.DeliveryLogBodyLimit bytes.
+type Delivery struct {
+	Id          int         `json:"id"`
+	RequestId   int         `json:"requestId"`
+	Destination string      `json:"destination"`
+	Attempt     int         `json:"attempt"`
+	Status      int         `json:"status"`
+	Error       string      `json:"error"`
+	Headers     http.Header `json:"headers"`
+	Body        []byte      `json:"body"`
+	Truncated   bool        `json:"truncated"`
+	DurationMs  int64       `json:"durationMs"`
+	AttemptedOn time.Time   `json:"attemptedOn"`
+}
+
+const deliveryColumns = `id, requestId, destination, attempt, status, error, responseHeaders, responseBody, truncated, durationMs, attemptedOn`
+
+// response is what the upstream answered to a delivery attempt, status is 0
+// when no answer came back.
+type response struct {
+	status    int
+	headers   http.Header
+	body      []byte
+	truncated bool
+	duration  time.Duration
+}
+
+// readResponse reads up to limit bytes of the body of res.
+func readResponse(res *http.Response, limit int) response {
+	limit = max(limit, 0)
+	body, _ := io.ReadAll(io.LimitReader(res.Body, int64(limit)+1))
+
+	return response{
+		status:  res.StatusCode,
+		headers: res.Header,
+		body:    body,
+	}.truncate(limit)
+}
+
+func (r response) truncate(limit int) response {
+	limit = max(limit, 0)
+	if len(r.body) > limit {
+		r.body = r.body[:limit]
+		r.truncated = true
+	}
+
+	return r
+}
+
+// recordDelivery logs the outcome of an attempt to deliver req, failing to do
+// so doesn't stop the dispatch.
+func recordDelivery(ctx context.Context, opts requestProcessingOpts, req Request, res response, deliveryErr error) {
+	res = res.truncate(config.DeliveryLogBodyLimit)
+
+	delivery := Delivery{
+		RequestId:   req.Id,
+		Destination: req.Destination,
+		Attempt:     req.Attempts + 1,
+		Status:      res.status,
+		Headers:     res.headers,
+		Body:        res.body,
+		Truncated:   res.truncated,
+		DurationMs:  res.duration.Milliseconds(),
+		AttemptedOn: time.Now(),
+	}
+	if deliveryErr != nil {
+		delivery.Error = deliveryErr.Error()
+	}
+
+	err := opts.store.RecordDelivery(ctx, delivery)
+	if err != nil {
+		log.Println("error while recording delivery", err)
+	}
+}
+
+// pruneDeliveryLogPeriodically prunes the delivery log on startup and then
+// every 24th of config.DeliveryLogRetention, at most hourly, until ctx is done.
+func pruneDeliveryLogPeriodically(ctx context.Context, store Store) {
+	if config.DeliveryLogRetention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(max(min(config.DeliveryLogRetention/24, time.Hour), time.Second))
+	defer ticker.Stop()
+
+	for {
+		pruneDeliveryLog(ctx, store)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneDeliveryLog removes the deliveries older than
+// config.DeliveryLogRetention, a retention of 0 keeps them forever.
+func pruneDeliveryLog(ctx context.Context, store Store) {
+	if config.DeliveryLogRetention <= 0 {
+		return
+	}
+
+	pruned, err := store.PruneDeliveries(ctx, time.Now().Add(-config.DeliveryLogRetention))
+	if err != nil {
+		log.Println("error while pruning the delivery log", err)
+	} else if pruned > 0 {
+		log.Printf("pruned %d deliveries from the delivery log", pruned)
+	}
+}
+
+func scanDelivery(row scanner) (Delivery, error) {
+	var (
+		delivery    Delivery
+		deliveryErr sql.NullString
+		headers     sql.NullString
+	)
+
+	scanErr := row.Scan(
+		&delivery.Id,
+		&delivery.RequestId,
+		&delivery.Destination,
+		&delivery.Attempt,
+		&delivery.Status,
+		&deliveryErr,
+		&headers,
+		&delivery.Body,
+		&delivery.Truncated,
+		&delivery.DurationMs,
+		&delivery.AttemptedOn,
+	)
+	if scanErr != nil {
+		return delivery, scanErr
+	}
+
+	delivery.Error = deliveryErr.String
+	if headers.Valid {
+		headersErr := json.Unmarshal([]byte(headers.String), &delivery.Headers)
+		if headersErr != nil {
+			return delivery, headersErr
+		}
+	}
+
+	return delivery, nil
+}
+
+func (s *sqlStore) RecordDelivery(ctx context.Context, delivery Delivery) error {
+	var headers any
+	if len(delivery.Headers) > 0 {
+		headersBytes, headersErr := json.Marshal(delivery.Headers)
+		if headersErr != nil {
+			return headersErr
+		}
+		headers = string(headersBytes)
+	}
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO DeliveryLog (requestId, destination, attempt, status, error, responseHeaders, responseBody, truncated, durationMs, attemptedOn)
+		VALUES (@requestId, @destination, @attempt, @status, @error, @headers, @body, @truncated, @durationMs, @attemptedOn)`,
+		s.args(
+			sql.Named("requestId", delivery.RequestId),
+			sql.Named("destination", delivery.Destination),
+			sql.Named("attempt", delivery.Attempt),
+			sql.Named("status", delivery.Status),
+			sql.Named("error", nullableString(delivery.Error)),
+			sql.Named("headers", headers),
+			sql.Named("body", delivery.Body),
+			sql.Named("truncated", delivery.Truncated),
+			sql.Named("durationMs", delivery.DurationMs),
+			sql.Named("attemptedOn", delivery.AttemptedOn),
+		)...,
+	)
+
+	return err
+}
+
+// ListDeliveries returns a page of the delivery log, latest attempts first,
+// along with the total number of matching deliveries. A requestId of 0 lists
+// the deliveries of every request, only the destination, limit and offset of
+// opts are used.
+func (s *sqlStore) ListDeliveries(ctx context.Context, requestId int, opts ListOptions) ([]Delivery, int, error) {
+	const filter = `(@requestId = 0 OR requestId = @requestId) AND (@destination = '' OR destination = @destination)`
+
+	args := s.args(
+		sql.Named("requestId", requestId),
+		sql.Named("destination", opts.Destination),
+		sql.Named("limit", sqlLimit(opts.Limit)),
+		sql.Named("offset", opts.Offset),
+	)
+
+	var total int
+
+	countErr := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM DeliveryLog WHERE `+filter, args...).Scan(&total)
+	if countErr != nil {
+		return nil, 0, countErr
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT `+deliveryColumns+` FROM DeliveryLog WHERE `+filter+` ORDER BY id DESC `+s.dialect.limit+` OFFSET @offset`,
+		args...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []Delivery{}
+
+	for rows.Next() {
+		delivery, scanErr := scanDelivery(rows)
+		if scanErr != nil {
+			return nil, 0, scanErr
+		}
+
+		results = append(results, delivery)
+	}
+
+	return results, total, rows.Err()
+}
+
+func (s *sqlStore) PruneDeliveries(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.dialect.pruneDeliveries, s.args(sql.Named("before", before))...)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, affectedErr := res.RowsAffected()
+	return int(pruned), affectedErr
+}
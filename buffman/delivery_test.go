@@ -0,0 +1,106 @@
+package buffman
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	config.DeliveryLogBodyLimit = 8
+	t.Cleanup(func() { config.DeliveryLogBodyLimit = 0 })
+
+	t.Run("every attempt is recorded with the upstream response", func(t *testing.T) {
+		status := http.StatusServiceUnavailable
+		server := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", "fma")
+			w.WriteHeader(status)
+			w.Write([]byte(strings.Repeat("x", 32)))
+		})
+
+		store := createTestStore(t)
+		opts := requestProcessingOpts{
+			store: store,
+			owner: "tests",
+			destinations: map[string]*destination{
+				"fma": {Destination: config.Destination{Name: "fma", URL: server.URL}, auth: noAuth{}},
+			},
+		}
+
+		req, err := store.Enqueue(ctx, Request{Destination: "fma", Payload: []byte("{}"), CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dispatchGroup(ctx, opts, leaseAll(t, store))
+
+		status = http.StatusOK
+		if err := store.RetryNow(ctx, req.Id); err != nil {
+			t.Fatal(err)
+		}
+		dispatchGroup(ctx, opts, leaseAll(t, store))
+
+		deliveries, total, err := store.ListDeliveries(ctx, req.Id, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if total != 2 {
+			t.Fatalf("expected 2 deliveries but got %+v", deliveries)
+		}
+
+		succeeded, failed := deliveries[0], deliveries[1]
+
+		if failed.Status != http.StatusServiceUnavailable || failed.Error == "" || failed.Attempt != 1 {
+			t.Errorf("expected the failed attempt to be recorded but got %+v", failed)
+		}
+		if succeeded.Status != http.StatusOK || succeeded.Error != "" || succeeded.Attempt != 2 {
+			t.Errorf("expected the successful attempt to be recorded but got %+v", succeeded)
+		}
+		if string(succeeded.Body) != "xxxxxxxx" || !succeeded.Truncated || succeeded.Headers.Get("X-Upstream") != "fma" {
+			t.Errorf("expected the response to be captured up to the limit but got %+v", succeeded)
+		}
+	})
+
+	t.Run("old deliveries are pruned apart from polling", func(t *testing.T) {
+		originalRetention := config.DeliveryLogRetention
+		t.Cleanup(func() { config.DeliveryLogRetention = originalRetention })
+		config.DeliveryLogRetention = time.Hour
+
+		store := createTestStore(t)
+
+		for _, attemptedOn := range []time.Time{time.Now().Add(-time.Hour * 2), time.Now()} {
+			err := store.RecordDelivery(ctx, Delivery{RequestId: 1, Destination: "fma", Attempt: 1, Status: http.StatusOK, AttemptedOn: attemptedOn})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pruneCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pruneDeliveryLogPeriodically(pruneCtx, store)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			_, total, err := store.ListDeliveries(ctx, 0, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			} else if total == 1 {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("expected the old delivery to be pruned on startup but %d are left", total)
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+}
@@ -1,13 +1,14 @@
 package buffman
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mse99/buffman/config"
@@ -16,8 +17,33 @@ import (
 var processRequestsNow = make(chan struct{})
 
 type requestProcessingOpts struct {
-	db *sql.DB
-	tk *fmaToken
+	store        Store
+	destinations map[string]*destination
+	// owner is the name requests are leased under.
+	owner string
+}
+
+// destination is a configured upstream along with its authenticator.
+type destination struct {
+	config.Destination
+	auth     authenticator
+	breaker  *circuitBreaker
+	throttle *throttle
+}
+
+// available tells whether requests can be sent to the destination now, it
+// isn't while the destination asked to be left alone or its circuit breaker
+// is open. Otherwise it also returns until when its requests are held back.
+func (d *destination) available() (time.Time, bool) {
+	if until, paused := d.throttle.paused(); paused {
+		log.Printf("%s is paused, holding back its requests", d.Name)
+		return until, false
+	} else if !d.breaker.allow() {
+		log.Printf("circuit breaker of %s is open, holding back its requests", d.Name)
+		return d.breaker.probeAt(), false
+	}
+
+	return time.Time{}, true
 }
 
 func processStoredRequests(ctx context.Context, opts requestProcessingOpts) {
@@ -33,82 +59,412 @@ func processStoredRequests(ctx context.Context, opts requestProcessingOpts) {
 			return
 		case <-timer.C:
 			log.Println("timed poll for stored requests")
-			loadAndDispatch(ctx, opts)
+			dispatchBacklog(ctx, opts)
 		case <-processRequestsNow:
 			log.Println("polling because of a poll signal")
-			loadAndDispatch(ctx, opts)
+			dispatchBacklog(ctx, opts)
 		}
 	}
 }
 
-func loadAndDispatch(ctx context.Context, opts requestProcessingOpts) {
-	requests, err := loadUnfinishedRequests(ctx, opts.db)
+// dispatchBacklog works through the backlog one batch of config.BatchSize
+// requests at a time, so memory stays flat whatever the size of the backlog.
+// It stops at the first batch that is not full or where nothing could be
+// delivered, the rest waits for the next poll.
+func dispatchBacklog(ctx context.Context, opts requestProcessingOpts) {
+	for loadAndDispatch(ctx, opts) && ctx.Err() == nil {
+	}
+}
+
+// loadAndDispatch leases and dispatches a batch of requests, reporting whether
+// the batch was full and made progress.
+func loadAndDispatch(ctx context.Context, opts requestProcessingOpts) bool {
+	defer func() {
+		gaugesErr := updateBacklogGauges(ctx, opts.store)
+		if gaugesErr != nil {
+			log.Println("error while updating backlog metrics", gaugesErr)
+		}
+	}()
+
+	requests, err := opts.store.Lease(ctx, opts.owner, config.LeaseDuration, config.BatchSize)
 	if err != nil {
 		log.Println("error while loading requests", err)
-		return
+		return false
+	}
+
+	groups := groupByOrderingKey(requests)
+	queue := make(chan []Request, len(groups))
+	for _, group := range groups {
+		queue <- group
+	}
+	close(queue)
+
+	delivered := atomic.Int64{}
+
+	wg := sync.WaitGroup{}
+	for range min(max(config.Workers, 1), len(groups)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for group := range queue {
+				delivered.Add(int64(dispatchGroup(ctx, opts, group)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return config.BatchSize > 0 && len(requests) >= config.BatchSize && delivered.Load() > 0
+}
+
+// groupByOrderingKey splits requests into the sequences that have to be sent
+// in order, requests of a destination that share an ordering key.
+func groupByOrderingKey(requests []Request) [][]Request {
+	type groupKey struct {
+		destination string
+		orderingKey string
 	}
 
+	indexes := map[groupKey]int{}
+	groups := [][]Request{}
+
 	for _, req := range requests {
-		err := dispatchRequest(ctx, req, opts)
+		key := groupKey{req.Destination, req.OrderingKey}
+
+		idx, found := indexes[key]
+		if !found {
+			idx = len(groups)
+			indexes[key] = idx
+			groups = append(groups, nil)
+		}
+
+		groups[idx] = append(groups[idx], req)
+	}
+
+	return groups
+}
+
+// dispatchGroup sends a group of requests sharing an ordering key one after
+// the other, stopping at the first failure unless config.ContinueOnError is set.
+// The requests it stops before are released rather than left leased until
+// their lease expires, or held back while the destination is unavailable. It returns the number of requests delivered.
+func dispatchGroup(ctx context.Context, opts requestProcessingOpts, group []Request) int {
+	if dest, found := opts.destinations[group[0].Destination]; found && dest.Batch.Enabled() {
+		return dispatchBatches(ctx, opts, dest, group)
+	}
+
+	delivered := 0
+
+	for i, req := range group {
+		dest, found := opts.destinations[req.Destination]
+
+		if found {
+			if until, ok := dest.available(); !ok {
+				holdRequests(ctx, opts, group[i:], until)
+				return delivered
+			}
+		}
+
+		if !extendLease(ctx, opts, group[i:]) {
+			releaseRequests(ctx, opts, group[i:])
+			return delivered
+		}
+
+		var (
+			res response
+			err error
+		)
+		if found {
+			res, err = dispatchRequest(ctx, req, dest)
+			recordDelivery(ctx, opts, req, res, err)
+		} else {
+			err = fmt.Errorf("unknown destination %s", req.Destination)
+		}
 
 		if err != nil {
-			log.Println("error while dispatching request", err)
+			// once the request is in the dead letters the ones after it can go
+			dropped := failRequest(ctx, opts, req, dest, res, err)
 
-			if !config.ContinueOnError {
-				log.Println("stopping dispatch")
-				return
+			if !dropped && !config.ContinueOnError {
+				log.Printf("stopping dispatch to %s for ordering key %q", req.Destination, req.OrderingKey)
+				releaseRequests(ctx, opts, group[i+1:])
+				return delivered
 			}
+
+			continue
+		}
+
+		ackRequest(ctx, opts, req)
+		delivered++
+	}
+
+	return delivered
+}
+
+// ackRequest removes a delivered request from the backlog.
+func ackRequest(ctx context.Context, opts requestProcessingOpts, req Request) {
+	requestsDispatched.WithLabelValues(req.Destination).Inc()
+
+	ackErr := opts.store.Ack(ctx, opts.owner, req.Id)
+	if errors.Is(ackErr, ErrLeaseLost) {
+		log.Printf("lost the lease of request %d before acking it, it may be delivered again", req.Id)
+	} else if ackErr != nil {
+		log.Println("error while removing dispatched request", ackErr)
+	}
+}
+
+// releaseRequests gives up the lease of requests that weren't attempted, so
+// they are due again on the next poll.
+func releaseRequests(ctx context.Context, opts requestProcessingOpts, requests []Request) {
+	for _, req := range requests {
+		releaseErr := opts.store.Release(ctx, opts.owner, req.Id)
+		if errors.Is(releaseErr, ErrLeaseLost) {
+			log.Printf("lost the lease of request %d before releasing it", req.Id)
+		} else if releaseErr != nil {
+			log.Println("error while releasing request", releaseErr)
 		}
+	}
+}
+
+// extendLease renews the lease of the requests of a group that are still to
+// be sent, so it doesn't run out while the ones before them are sent. It tells
+// whether they are all still leased, the group stops otherwise since another
+// owner may be sending the rest of it.
+func extendLease(ctx context.Context, opts requestProcessingOpts, requests []Request) bool {
+	ids := make([]int, len(requests))
+	for i, req := range requests {
+		ids[i] = req.Id
+	}
 
-		deleteRequestByID(ctx, opts.db, req.Id)
+	extendErr := opts.store.Extend(ctx, opts.owner, ids, config.LeaseDuration)
+	if errors.Is(extendErr, ErrLeaseLost) {
+		log.Printf("lost the lease of requests to %s for ordering key %q, stopping their dispatch", requests[0].Destination, requests[0].OrderingKey)
+		return false
+	} else if extendErr != nil {
+		log.Println("error while extending lease", extendErr)
+		return false
 	}
+
+	return true
 }
 
-func dispatchRequest(ctx context.Context, req Request, opts requestProcessingOpts) error {
+// holdRequests holds back requests that weren't attempted because their
+// destination is unavailable until it is expected to be available again, so
+// they don't take the place of requests to other destinations in the next
+// leases.
+func holdRequests(ctx context.Context, opts requestProcessingOpts, requests []Request, until time.Time) {
+	for _, req := range requests {
+		holdErr := opts.store.Hold(ctx, opts.owner, req.Id, until)
+		if errors.Is(holdErr, ErrLeaseLost) {
+			log.Printf("lost the lease of request %d before holding it back", req.Id)
+		} else if holdErr != nil {
+			log.Println("error while holding back request", holdErr)
+		}
+	}
+}
+
+// failRequest records a failed attempt to deliver a request, dest is nil when
+// the request's destination is no longer configured. It tells whether the
+// request was moved to the dead letters.
+func failRequest(ctx context.Context, opts requestProcessingOpts, req Request, dest *destination, res response, err error) bool {
+	log.Println("error while dispatching request", err)
+	requestsFailed.WithLabelValues(req.Destination).Inc()
+
+	retry := config.RetryPolicy{}
+	if dest != nil {
+		retry = dest.Retry
+	}
+
+	retryAt, _ := retryAfter(res.status, res.headers, time.Now())
+
+	dropped, failErr := handleFailedAttempt(ctx, opts.store, opts.owner, req, retry.Resolve(), res.status, retryAt, err)
+	if errors.Is(failErr, ErrLeaseLost) {
+		log.Printf("lost the lease of request %d before recording its failed attempt", req.Id)
+	} else if failErr != nil {
+		log.Println("error while recording failed attempt", failErr)
+	}
+
+	return dropped
+}
+
+// handleFailedAttempt counts the failed attempt against the request, schedules
+// its next attempt and moves it to the dead letters once it has used up the
+// attempts allowed by its destination's retry policy, or right away when the
+// failure is permanent. When the destination asked to be called again at
+// retryAt the attempt isn't counted and the request waits until then instead.
+// It tells whether the request was moved.
+func handleFailedAttempt(ctx context.Context, store Store, owner string, req Request, retry config.RetryPolicy, status int, retryAt time.Time, dispatchErr error) (bool, error) {
+	if !retryAt.IsZero() && !errors.Is(dispatchErr, errPermanentFailure) {
+		log.Printf("request %d postponed until %s as its destination asked", req.Id, retryAt.Format(time.RFC3339))
+		return false, store.Postpone(ctx, owner, req.Id, retryAt, status, dispatchErr)
+	}
+
+	// the attempts of a request only change under its lease
+	attempts := req.Attempts + 1
+
+	if errors.Is(dispatchErr, errPermanentFailure) {
+		log.Printf("request %d failed permanently, moving it to the dead letters", req.Id)
+	} else if retry.MaxAttempts <= 0 || attempts < retry.MaxAttempts {
+		nextAttemptAt := time.Now().Add(nextBackoff(retry, attempts))
+
+		_, err := store.Nack(ctx, owner, req.Id, nextAttemptAt, status, dispatchErr)
+		return false, err
+	} else {
+		log.Printf("request %d failed %d times, moving it to the dead letters", req.Id, attempts)
+	}
+
+	moveErr := store.DeadLetter(ctx, owner, req.Id, status, dispatchErr)
+	if moveErr != nil {
+		return false, moveErr
+	}
+
+	requestsDropped.WithLabelValues(req.Destination).Inc()
+	return true, nil
+}
+
+// dispatchRequest sends the request to its destination and reads the start of
+// the response for the delivery log.
+func dispatchRequest(ctx context.Context, req Request, dest *destination) (response, error) {
+	start := time.Now()
+
+	res, err := sendWithRenewal(dest, func() (*http.Response, error) {
+		return sendRequest(ctx, req, dest)
+	})
+	if err != nil {
+		failed := response{duration: time.Since(start)}
+		return failed, classifyAttempt(dest, failed, err)
+	}
+	defer res.Body.Close()
+
+	captured := readResponse(res, max(config.DeliveryLogBodyLimit, maxClassifiedBodySize))
+	captured.duration = time.Since(start)
+
+	return captured, classifyAttempt(dest, captured, nil)
+}
+
+// sendWithRenewal sends the request built by send, when the destination
+// rejects the credentials it is sent again once they have been renewed. The
+// outcome is counted by the destination's circuit breaker.
+func sendWithRenewal(dest *destination, send func() (*http.Response, error)) (*http.Response, error) {
+	res, err := send()
+	if err == nil && isAuthRejection(res.StatusCode) && dest.auth.invalidate(res.Request) {
+		log.Printf("%s rejected our credentials, retrying with renewed ones", dest.Name)
+		res.Body.Close()
+
+		res, err = send()
+	}
+
+	dest.breaker.record(res, err)
+
+	return res, err
+}
+
+func isAuthRejection(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+func sendRequest(ctx context.Context, req Request, dest *destination) (*http.Response, error) {
 	httpReq, httpReqErr := http.NewRequestWithContext(
 		ctx,
-		http.MethodPost,
-		config.FmaDispatchURL,
-		strings.NewReader(req.Payload),
+		req.Method,
+		replayURL(dest.URL, req.Query),
+		bytes.NewReader(req.Payload),
 	)
 	if httpReqErr != nil {
-		return httpReqErr
+		return nil, httpReqErr
 	}
 
-	httpReq.Header.Add("Content-Type", "application/json")
-	httpReq.Header.Add(
-		"Authorization",
-		fmt.Sprintf(`Bearer %s`, opts.tk.get()),
-	)
+	for key, values := range req.Headers {
+		httpReq.Header[key] = values
+	}
+	if req.ContentType != "" {
+		httpReq.Header.Set("Content-Type", req.ContentType)
+	}
+	if req.ContentEncoding != "" {
+		httpReq.Header.Set("Content-Encoding", req.ContentEncoding)
+	}
+	for key, val := range dest.Headers {
+		httpReq.Header.Set(key, val)
+	}
+	if req.IdempotencyKey != "" {
+		httpReq.Header.Set(idempotencyKeyHeader, req.IdempotencyKey)
+	}
 
-	res, resErr := http.DefaultClient.Do(httpReq)
-	if resErr != nil {
-		return resErr
-	} else if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("received none 200 status code: %d", res.StatusCode)
+	return sendUpstream(dest, httpReq)
+}
+
+// sendUpstream authorizes a request with the destination's credentials and
+// sends it once the destination's rate limit allows. Calls are bounded by the
+// destination's timeout, or config.UpstreamTimeout when it has none.
+func sendUpstream(dest *destination, httpReq *http.Request) (*http.Response, error) {
+	waitErr := dest.throttle.wait(httpReq.Context())
+	if waitErr != nil {
+		return nil, waitErr
 	}
 
-	return nil
+	dest.auth.authorize(httpReq)
+
+	timeout := dest.Timeout.Duration
+	if timeout <= 0 {
+		timeout = config.UpstreamTimeout
+	}
+
+	client := http.DefaultClient
+	if timeout > 0 {
+		client = &http.Client{Timeout: timeout}
+	}
+
+	start := time.Now()
+	res, resErr := client.Do(httpReq)
+	dispatchDuration.WithLabelValues(dest.Name).Observe(time.Since(start).Seconds())
+
+	if resErr == nil {
+		dest.throttle.observe(res)
+	}
+
+	return res, resErr
 }
 
-func QueueRequest(ctx context.Context, db *sql.DB, payload string) error {
-	if len(strings.Trim(payload, " ")) == 0 {
-		return errors.New("request payload cannot be empty")
+// QueueRequest stores an inbound request in the backlog and wakes up the
+// dispatcher. ErrDuplicateRequest is returned when its idempotency key was
+// already queued within config.IdempotencyWindow, and ErrBacklogFull when
+// there's no room left for it.
+func QueueRequest(ctx context.Context, store Store, in Inbound) error {
+	if len(in.Payload) == 0 && carriesBody(in.Method) {
+		return ErrEmptyPayload
 	}
 
-	_, err := insertRequest(ctx, db, Request{
-		Payload:   payload,
-		CreatedOn: time.Now(),
-	})
+	dest, found := config.FindDestination(in.Destination)
+	if !found {
+		return fmt.Errorf("unknown destination %s", in.Destination)
+	}
 
+	_, err := store.Enqueue(ctx, Request{
+		Destination:     in.Destination,
+		OrderingKey:     extractOrderingKey(dest.OrderingKey, in),
+		IdempotencyKey:  extractIdempotencyKey(dest.IdempotencyKeyPath, in),
+		Method:          in.Method,
+		Headers:         forwardedHeaders(dest.ForwardHeaders, in.Headers),
+		Query:           in.Query,
+		ContentType:     in.ContentType,
+		ContentEncoding: in.ContentEncoding,
+		ApiKey:          in.ApiKey,
+		Payload:         in.Payload,
+		CreatedOn:       time.Now(),
+	})
 	if err != nil {
 		return err
 	}
+	requestsQueued.WithLabelValues(in.Destination).Inc()
+
+	signalProcessing(ctx)
+	return nil
+}
 
+// signalProcessing wakes up the dispatcher so it doesn't wait for the next poll.
+func signalProcessing(ctx context.Context) {
 	select {
 	case processRequestsNow <- struct{}{}:
-		return nil
 	case <-ctx.Done():
-		return nil
 	}
 }
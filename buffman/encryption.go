@@ -0,0 +1,259 @@
+package buffman
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/mse99/buffman/config"
+)
+
+// ErrUndecryptable is returned for stored payloads that can't be decrypted
+// with the configured keys, e.g. because their key was removed.
+var ErrUndecryptable = errors.New("payload cannot be decrypted")
+
+// reencryptBatchSize is how many rows reencryptPayloads loads per query.
+const reencryptBatchSize = 100
+
+// encryptPayload seals a payload with a fresh data key, which is in turn sealed
+// with the active key. Payloads are returned as is when no key is configured.
+func encryptPayload(payload []byte) ([]byte, string, []byte, error) {
+	if config.ActiveEncryptionKey == "" {
+		return payload, "", nil, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", nil, err
+	}
+
+	sealed, sealErr := gcmSeal(dataKey, payload, nil)
+	if sealErr != nil {
+		return nil, "", nil, sealErr
+	}
+
+	wrappedKey, wrapErr := wrapDataKey(config.ActiveEncryptionKey, dataKey)
+	if wrapErr != nil {
+		return nil, "", nil, wrapErr
+	}
+
+	return sealed, config.ActiveEncryptionKey, wrappedKey, nil
+}
+
+// decryptPayload reverses encryptPayload, payloads stored without a key id
+// were never encrypted and are returned untouched.
+func decryptPayload(payload []byte, keyId string, wrappedKey []byte) ([]byte, error) {
+	if keyId == "" {
+		return payload, nil
+	}
+
+	dataKey, unwrapErr := unwrapDataKey(keyId, wrappedKey)
+	if unwrapErr != nil {
+		return nil, unwrapErr
+	}
+
+	plaintext, openErr := gcmOpen(dataKey, payload, nil)
+	if openErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUndecryptable, openErr)
+	}
+
+	return plaintext, nil
+}
+
+// wrapDataKey seals a data key with a key encryption key, the key id is
+// authenticated along with it so wrapped keys can't be swapped between keys.
+func wrapDataKey(keyId string, dataKey []byte) ([]byte, error) {
+	key, found := config.EncryptionKeys[keyId]
+	if !found {
+		return nil, fmt.Errorf("unknown encryption key %s", keyId)
+	}
+
+	return gcmSeal(key, dataKey, []byte(keyId))
+}
+
+func unwrapDataKey(keyId string, wrappedKey []byte) ([]byte, error) {
+	key, found := config.EncryptionKeys[keyId]
+	if !found {
+		return nil, fmt.Errorf("%w: unknown encryption key %s", ErrUndecryptable, keyId)
+	}
+
+	dataKey, err := gcmOpen(key, wrappedKey, []byte(keyId))
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key does not match encryption key %s", ErrUndecryptable, keyId)
+	}
+
+	return dataKey, nil
+}
+
+// gcmSeal encrypts plaintext with AES-GCM, prefixing the result with its nonce.
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, randErr := rand.Read(nonce); randErr != nil {
+		return nil, randErr
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func gcmOpen(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Reencrypt moves every stored payload to the active key: data keys
+// sealed with another key are rewrapped and payloads stored before
+// encryption was enabled get encrypted. Rows that can't be decrypted are
+// logged and left alone.
+func (s *sqlStore) Reencrypt(ctx context.Context) error {
+	if config.ActiveEncryptionKey == "" {
+		return nil
+	}
+
+	for _, table := range []string{"RequestsBacklog", "DeadLetters"} {
+		err := s.reencryptTable(ctx, table)
+		if err != nil {
+			return fmt.Errorf("error while re-encrypting %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+type encryptedRow struct {
+	id         int
+	keyId      sql.NullString
+	wrappedKey []byte
+	payload    []byte
+}
+
+func (s *sqlStore) reencryptTable(ctx context.Context, table string) error {
+	lastId := 0
+
+	for {
+		rows, err := s.loadRowsToReencrypt(ctx, table, lastId)
+		if err != nil {
+			return err
+		} else if len(rows) == 0 {
+			return nil
+		}
+
+		for _, row := range rows {
+			lastId = row.id
+
+			rowErr := s.reencryptRow(ctx, table, row)
+			if errors.Is(rowErr, ErrUndecryptable) {
+				log.Printf("cannot re-encrypt row %d of %s: %v", row.id, table, rowErr)
+			} else if rowErr != nil {
+				return rowErr
+			}
+		}
+	}
+}
+
+func (s *sqlStore) loadRowsToReencrypt(ctx context.Context, table string, afterId int) ([]encryptedRow, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		fmt.Sprintf(`SELECT id, keyId, wrappedKey, payload FROM %s
+		WHERE id > @afterId AND (keyId IS NULL OR keyId != @activeKey)
+		ORDER BY id ASC LIMIT @limit`, table),
+		s.args(
+			sql.Named("afterId", afterId),
+			sql.Named("activeKey", config.ActiveEncryptionKey),
+			sql.Named("limit", reencryptBatchSize),
+		)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []encryptedRow{}
+
+	for rows.Next() {
+		var row encryptedRow
+
+		scanErr := rows.Scan(&row.id, &row.keyId, &row.wrappedKey, &row.payload)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+
+		results = append(results, row)
+	}
+
+	return results, rows.Err()
+}
+
+// reencryptRow only touches the row when it still has the key it was loaded
+// with, in case it was requeued or rewritten in the meantime.
+func (s *sqlStore) reencryptRow(ctx context.Context, table string, row encryptedRow) error {
+	if !row.keyId.Valid {
+		sealed, keyId, wrappedKey, err := encryptPayload(row.payload)
+		if err != nil {
+			return err
+		}
+
+		_, updateErr := s.db.ExecContext(
+			ctx,
+			fmt.Sprintf(`UPDATE %s SET payload = @payload, keyId = @keyId, wrappedKey = @wrappedKey
+			WHERE id = @id AND keyId IS NULL`, table),
+			s.args(
+				sql.Named("payload", sealed),
+				sql.Named("keyId", keyId),
+				sql.Named("wrappedKey", wrappedKey),
+				sql.Named("id", row.id),
+			)...,
+		)
+		return updateErr
+	}
+
+	dataKey, unwrapErr := unwrapDataKey(row.keyId.String, row.wrappedKey)
+	if unwrapErr != nil {
+		return unwrapErr
+	}
+
+	wrappedKey, wrapErr := wrapDataKey(config.ActiveEncryptionKey, dataKey)
+	if wrapErr != nil {
+		return wrapErr
+	}
+
+	_, updateErr := s.db.ExecContext(
+		ctx,
+		fmt.Sprintf(`UPDATE %s SET keyId = @keyId, wrappedKey = @wrappedKey
+		WHERE id = @id AND keyId = @previousKeyId`, table),
+		s.args(
+			sql.Named("keyId", config.ActiveEncryptionKey),
+			sql.Named("wrappedKey", wrappedKey),
+			sql.Named("id", row.id),
+			sql.Named("previousKeyId", row.keyId.String),
+		)...,
+	)
+	return updateErr
+}
@@ -0,0 +1,167 @@
+package buffman
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func useEncryptionKeys(t *testing.T, active string, ids ...string) map[string][]byte {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		keys[id] = key
+	}
+
+	config.EncryptionKeys = keys
+	config.ActiveEncryptionKey = active
+	t.Cleanup(func() {
+		config.EncryptionKeys = nil
+		config.ActiveEncryptionKey = ""
+	})
+
+	return keys
+}
+
+func storedKeyId(t *testing.T, db *sql.DB, table string, id int) (string, []byte) {
+	var (
+		keyId   sql.NullString
+		payload []byte
+	)
+
+	err := db.QueryRowContext(ctx, `SELECT keyId, payload FROM `+table+` WHERE id = @id`, sql.Named("id", id)).Scan(&keyId, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyId.String, payload
+}
+
+func TestPayloadEncryption(t *testing.T) {
+	payload := []byte(`{ "customer": "Jane Doe" }`)
+
+	t.Run("payloads are encrypted at rest", func(t *testing.T) {
+		useEncryptionKeys(t, "k1", "k1")
+		store := connectToTestingStore(t)
+
+		req, err := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(req.Payload, payload) {
+			t.Errorf("expected the payload to be decrypted when read but got %s", req.Payload)
+		}
+
+		keyId, stored := storedKeyId(t, store.db, "RequestsBacklog", req.Id)
+		if keyId != "k1" || bytes.Contains(stored, []byte("Jane Doe")) {
+			t.Errorf("expected the payload to be stored encrypted with k1 but got %s %q", keyId, stored)
+		}
+	})
+
+	t.Run("rotating keys re-encrypts stored payloads", func(t *testing.T) {
+		keys := useEncryptionKeys(t, "", "old")
+		store := connectToTestingStore(t)
+
+		plain, err := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.ActiveEncryptionKey = "old"
+		encrypted, err := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		newKey := make([]byte, 32)
+		rand.Read(newKey)
+		config.EncryptionKeys = map[string][]byte{"new": newKey, "old": keys["old"]}
+		config.ActiveEncryptionKey = "new"
+
+		reencryptErr := store.Reencrypt(ctx)
+		if reencryptErr != nil {
+			t.Fatal(reencryptErr)
+		}
+
+		// the old key is no longer needed once everything was rewrapped
+		config.EncryptionKeys = map[string][]byte{"new": newKey}
+
+		for _, id := range []int{plain.Id, encrypted.Id} {
+			if keyId, _ := storedKeyId(t, store.db, "RequestsBacklog", id); keyId != "new" {
+				t.Errorf("expected request %d to be encrypted with the new key but got %q", id, keyId)
+			}
+
+			req, getErr := store.GetRequest(ctx, id)
+			if getErr != nil {
+				t.Fatal(getErr)
+			} else if !bytes.Equal(req.Payload, payload) {
+				t.Errorf("unexpected payload for request %d %s", id, req.Payload)
+			}
+		}
+	})
+
+	t.Run("undecryptable requests are held back", func(t *testing.T) {
+		useEncryptionKeys(t, "lost", "lost")
+		store := connectToTestingStore(t)
+
+		req, err := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.EncryptionKeys = map[string][]byte{}
+		config.ActiveEncryptionKey = ""
+
+		later, laterErr := store.Enqueue(ctx, Request{Payload: payload, CreatedOn: time.Now()})
+		if laterErr != nil {
+			t.Fatal(laterErr)
+		}
+
+		requests, loadErr := store.Lease(ctx, "tests", time.Minute, 0)
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		} else if len(requests) != 0 {
+			t.Errorf("expected the undecryptable request and the one queued after it to be held back but got %v", requestIds(requests...))
+		}
+
+		released, releasedErr := store.GetRequest(ctx, later.Id)
+		if releasedErr != nil {
+			t.Fatal(releasedErr)
+		} else if released.ClaimedBy != "" {
+			t.Errorf("expected the request queued after the undecryptable one to be released but got %+v", released)
+		}
+
+		held, getErr := store.GetRequest(ctx, req.Id)
+		if getErr != nil {
+			t.Fatal(getErr)
+		} else if held.Attempts != 0 || held.ClaimedBy != "" || !held.NextAttemptAt.After(time.Now()) {
+			t.Errorf("expected the request to be released and held back without an attempt but got %+v", held)
+		} else if !strings.Contains(held.LastError, "payload cannot be decrypted") {
+			t.Errorf("expected the request to explain why but got %q", held.LastError)
+		}
+
+		letters, lettersErr := loadDeadLetters(ctx, store)
+		if lettersErr != nil {
+			t.Fatal(lettersErr)
+		} else if len(letters) != 0 {
+			t.Fatalf("expected nothing to be dead lettered but got %+v", letters)
+		}
+
+		deadLetterErr := DeadLetterRequest(ctx, store, req.Id)
+		if deadLetterErr != nil {
+			t.Fatal(deadLetterErr)
+		}
+
+		letters, lettersErr = loadDeadLetters(ctx, store)
+		if lettersErr != nil {
+			t.Fatal(lettersErr)
+		} else if len(letters) != 1 || letters[0].RequestId != req.Id {
+			t.Fatalf("expected the request to be dead lettered but got %+v", letters)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package buffman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mse99/buffman/config"
+)
+
+// errPermanentFailure marks failed attempts that aren't worth retrying, the
+// request goes straight to the dead letters.
+var errPermanentFailure = errors.New("permanent failure")
+
+// maxClassifiedBodySize caps how much of a response is read for the body
+// patterns of failure rules.
+const maxClassifiedBodySize = 64 << 10
+
+// classifyAttempt applies the failure rules of dest to an attempt and returns
+// the error to record against the request, nil when it counts as delivered.
+func classifyAttempt(dest *destination, res response, err error) error {
+	switch failureAction(dest.Failures, res, err) {
+	case config.FailureSuccess:
+		return nil
+	case config.FailureDeadLetter:
+		return fmt.Errorf("%w: %w", errPermanentFailure, attemptErr(res, err))
+	default:
+		return attemptErr(res, err)
+	}
+}
+
+// failureAction returns the action of the first rule matching the attempt,
+// 2xx responses succeed and everything else is retried when none does.
+func failureAction(rules []config.FailureRule, res response, err error) string {
+	if action, matched := matchingAction(rules, res, err); matched {
+		return action
+	}
+
+	if err == nil && isSuccessStatus(res.status) {
+		return config.FailureSuccess
+	}
+
+	return config.FailureRetry
+}
+
+// matchingAction returns the action of the first rule matching the attempt,
+// if any.
+func matchingAction(rules []config.FailureRule, res response, err error) (string, bool) {
+	for _, rule := range rules {
+		if ruleMatches(rule, res, err) {
+			return rule.Action, true
+		}
+	}
+
+	return "", false
+}
+
+func ruleMatches(rule config.FailureRule, res response, err error) bool {
+	if rule.Error != "" {
+		return err != nil && (rule.Error == config.FailureNetwork || isTimeout(err))
+	} else if err != nil {
+		return false
+	}
+
+	if !rule.Status.IsZero() && !rule.Status.Contains(res.status) {
+		return false
+	}
+
+	return rule.Body.Regexp == nil || rule.Body.Match(res.body)
+}
+
+func attemptErr(res response, err error) error {
+	if err != nil {
+		return err
+	} else if !isSuccessStatus(res.status) {
+		return fmt.Errorf("received none 2xx status code: %d", res.status)
+	}
+
+	return fmt.Errorf("response with status code %d matched a failure rule", res.status)
+}
+
+func isSuccessStatus(status int) bool {
+	return status >= 200 && status < 300
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
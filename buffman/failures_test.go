@@ -0,0 +1,94 @@
+package buffman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestFailureClassification(t *testing.T) {
+	t.Run("rules are matched in order", func(t *testing.T) {
+		rules := []config.FailureRule{
+			{Status: config.StatusRange{Min: 409, Max: 409}, Action: config.FailureSuccess},
+			{Status: config.StatusRange{Min: 400, Max: 499}, Body: config.Pattern{Regexp: regexp.MustCompile("invalid")}, Action: config.FailureDeadLetter},
+			{Error: config.FailureTimeout, Action: config.FailureDeadLetter},
+		}
+
+		cases := []struct {
+			res      response
+			err      error
+			expected string
+		}{
+			{response{status: 204}, nil, config.FailureSuccess},
+			{response{status: 409}, nil, config.FailureSuccess},
+			{response{status: 400, body: []byte("invalid payload")}, nil, config.FailureDeadLetter},
+			{response{status: 400, body: []byte("try again")}, nil, config.FailureRetry},
+			{response{status: 503}, nil, config.FailureRetry},
+			{response{}, context.DeadlineExceeded, config.FailureDeadLetter},
+			{response{}, errors.New("connection refused"), config.FailureRetry},
+		}
+
+		for _, c := range cases {
+			if action := failureAction(rules, c.res, c.err); action != c.expected {
+				t.Errorf("expected %d %v to be classified %s but got %s", c.res.status, c.err, c.expected, action)
+			}
+		}
+	})
+
+	t.Run("permanent failures skip the retries", func(t *testing.T) {
+		status := http.StatusBadRequest
+		server := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"invalid payload"}`))
+		})
+
+		store := createTestStore(t)
+		opts := requestProcessingOpts{
+			store: store,
+			owner: "tests",
+			destinations: map[string]*destination{
+				"fma": {
+					Destination: config.Destination{
+						Name: "fma",
+						URL:  server.URL,
+						Failures: []config.FailureRule{
+							{Status: config.StatusRange{Min: 400, Max: 499}, Action: config.FailureDeadLetter},
+						},
+					},
+					auth: noAuth{},
+				},
+			},
+		}
+
+		for range 2 {
+			_, err := store.Enqueue(ctx, Request{Destination: "fma", OrderingKey: "order-1", Payload: []byte("{}"), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dispatchGroup(ctx, opts, leaseAll(t, store))
+
+		letters, total, err := store.ListDeadLetters(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if total != 2 || letters[0].LastStatus != http.StatusBadRequest || letters[0].Attempts != 1 {
+			t.Errorf("expected both requests to be dead lettered after one attempt but got %+v", letters)
+		}
+
+		status = http.StatusAccepted
+		_, err = store.Enqueue(ctx, Request{Destination: "fma", Payload: []byte("{}"), CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if delivered := dispatchGroup(ctx, opts, leaseAll(t, store)); delivered != 1 {
+			t.Errorf("expected a 202 to count as delivered but got %d delivered", delivered)
+		}
+	})
+}
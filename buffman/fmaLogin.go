@@ -0,0 +1,82 @@
+package buffman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// fmaLoginFetcher logs in by posting the configured username and password as
+// JSON and reads the token from the response at auth.TokenPath. The token's
+// lifetime is taken from an expiresIn field next to the token, or at the top
+// of the response, when there is one.
+func fmaLoginFetcher(destination string, auth config.AuthConfig) tokenFetcher {
+	return func(ctx context.Context) (issuedToken, error) {
+		return fetchApiTokenFromFma(ctx, destination, auth)
+	}
+}
+
+func fetchApiTokenFromFma(ctx context.Context, destination string, auth config.AuthConfig) (issuedToken, error) {
+	credentials, marshalErr := json.Marshal(map[string]string{
+		"username": auth.Username,
+		"password": auth.Password,
+	})
+	if marshalErr != nil {
+		return issuedToken{}, marshalErr
+	}
+
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, auth.LoginURL, bytes.NewReader(credentials))
+	if reqErr != nil {
+		return issuedToken{}, reqErr
+	}
+	req.Header.Add("Content-Type", "application/json")
+	for key, val := range auth.GetLoginHeaders() {
+		req.Header.Set(key, val)
+	}
+
+	start := time.Now()
+	res, resErr := http.DefaultClient.Do(req)
+	loginDuration.WithLabelValues(destination).Observe(time.Since(start).Seconds())
+
+	if resErr != nil {
+		return issuedToken{}, resErr
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return issuedToken{}, fmt.Errorf("received none 200 status code %v", res.StatusCode)
+	}
+
+	var responseBody any
+	decodeErr := json.NewDecoder(res.Body).Decode(&responseBody)
+	if decodeErr != nil {
+		return issuedToken{}, fmt.Errorf("error while reading response body: %w", decodeErr)
+	}
+
+	token, found := lookupJSONPath(responseBody, auth.GetTokenPath())
+	tokenStr, isStr := token.(string)
+	if !found || !isStr {
+		return issuedToken{}, errors.New("login response did not contain a token at " + auth.GetTokenPath())
+	}
+
+	tokenPath := strings.Split(auth.GetTokenPath(), ".")
+	tokenPath[len(tokenPath)-1] = "expiresIn"
+
+	expiresIn, found := lookupJSONPath(responseBody, strings.Join(tokenPath, "."))
+	if !found {
+		expiresIn, _ = lookupJSONPath(responseBody, "expiresIn")
+	}
+	expiresInSecs, _ := expiresIn.(float64)
+
+	return issuedToken{
+		value:     tokenStr,
+		expiresAt: tokenExpiry(tokenStr, expiresInSecs),
+	}, nil
+}
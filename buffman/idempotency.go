@@ -0,0 +1,69 @@
+package buffman
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// idempotencyKeyHeader is read from inbound requests and forwarded upstream.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// ErrDuplicateRequest is returned by QueueRequest for a request whose
+// idempotency key was already queued for the same destination.
+var ErrDuplicateRequest = errors.New("duplicate request")
+
+// extractIdempotencyKey reads the Idempotency-Key header of an inbound request,
+// falling back to the destination's JSON path.
+func extractIdempotencyKey(path string, in Inbound) string {
+	if key := in.Headers.Get(idempotencyKeyHeader); key != "" {
+		return key
+	}
+
+	if path != "" {
+		if key, found := lookupJSONPathString(in.Payload, path); found {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// claimIdempotencyKey records the key for a destination, keys older than
+// config.IdempotencyWindow are forgotten so they can be used again.
+func (s *sqlStore) claimIdempotencyKey(ctx context.Context, db querier, destination, key string, now time.Time) error {
+	_, expireErr := db.ExecContext(
+		ctx,
+		s.dialect.expireIdempotencyKeys,
+		s.args(sql.Named("expiredBefore", now.Add(-config.IdempotencyWindow)))...,
+	)
+	if expireErr != nil {
+		return expireErr
+	}
+
+	res, err := db.ExecContext(
+		ctx,
+		`INSERT INTO IdempotencyKeys (destination, key, createdOn) VALUES (@destination, @key, @createdOn)
+		ON CONFLICT (destination, key) DO NOTHING`,
+		s.args(
+			sql.Named("destination", destination),
+			sql.Named("key", key),
+			sql.Named("createdOn", now),
+		)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, affectedErr := res.RowsAffected()
+	if affectedErr != nil {
+		return affectedErr
+	} else if affected == 0 {
+		return ErrDuplicateRequest
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package buffman
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	config.IdempotencyWindow = time.Hour
+	t.Cleanup(func() { config.IdempotencyWindow = 0 })
+
+	t.Run("claiming a key twice within the window", func(t *testing.T) {
+		store := connectToTestingStore(t)
+		now := time.Now()
+
+		err := store.claimIdempotencyKey(ctx, store.db, "fma", "order-1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.claimIdempotencyKey(ctx, store.db, "fma", "order-1", now.Add(time.Minute))
+		if !errors.Is(err, ErrDuplicateRequest) {
+			t.Errorf("expected ErrDuplicateRequest but got %v", err)
+		}
+
+		err = store.claimIdempotencyKey(ctx, store.db, "erp", "order-1", now.Add(time.Minute))
+		if err != nil {
+			t.Errorf("expected keys to be scoped to their destination but got %v", err)
+		}
+
+		err = store.claimIdempotencyKey(ctx, store.db, "fma", "order-1", now.Add(time.Hour*2))
+		if err != nil {
+			t.Errorf("expected the key to be reusable after the window but got %v", err)
+		}
+	})
+
+	t.Run("extracting the key from the header or the payload", func(t *testing.T) {
+		in := Inbound{
+			Payload: []byte(`{"order":{"id":42}}`),
+			Headers: http.Header{},
+		}
+
+		if key := extractIdempotencyKey("order.id", in); key != "42" {
+			t.Errorf("expected key from the payload to be 42 but got %q", key)
+		}
+
+		in.Headers.Set("Idempotency-Key", "abc")
+		if key := extractIdempotencyKey("order.id", in); key != "abc" {
+			t.Errorf("expected key from the header to be abc but got %q", key)
+		}
+	})
+
+	t.Run("forwarding the key upstream", func(t *testing.T) {
+		forwarded := make(chan string, 1)
+		server := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			forwarded <- r.Header.Get("Idempotency-Key")
+			w.WriteHeader(http.StatusOK)
+		})
+
+		dest := &destination{Destination: config.Destination{Name: "fma", URL: server.URL}, auth: noAuth{}}
+
+		res, err := dispatchRequest(ctx, Request{Method: http.MethodPost, Payload: []byte("{}"), IdempotencyKey: "order-1"}, dest)
+		if err != nil || res.status != http.StatusOK {
+			t.Fatalf("unexpected dispatch result %d %v", res.status, err)
+		}
+
+		if key := <-forwarded; key != "order-1" {
+			t.Errorf("expected Idempotency-Key to be forwarded but got %q", key)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package buffman
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// defaultContentType is replayed for requests queued before their content type
+// was kept.
+const defaultContentType = "application/json"
+
+// ErrEmptyPayload is returned when queueing a request without a payload for a
+// method that is expected to carry one.
+var ErrEmptyPayload = errors.New("request payload cannot be empty")
+
+// Inbound is a request received for a destination, before it is queued.
+type Inbound struct {
+	Destination string
+	Method      string
+	Payload     []byte
+	Headers     http.Header
+	Query       string
+	ContentType string
+
+	// ContentEncoding is the Content-Encoding of Payload, e.g. gzip.
+	ContentEncoding string
+
+	// ApiKey is the name of the API key the request was received with.
+	ApiKey string
+}
+
+// carriesBody tells whether requests made with method are expected to have a
+// payload, an empty method is a POST.
+func carriesBody(method string) bool {
+	switch method {
+	case "", http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+
+	return false
+}
+
+// forwardedHeaders keeps the inbound headers that are in the allow list.
+func forwardedHeaders(allowed []string, headers http.Header) http.Header {
+	forwarded := http.Header{}
+
+	for _, name := range allowed {
+		if values := headers.Values(name); len(values) > 0 {
+			forwarded[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	return forwarded
+}
+
+// replayURL appends the query string of a queued request to the destination
+// URL, keeping the query parameters the destination URL already has.
+func replayURL(destinationURL, query string) string {
+	if query == "" {
+		return destinationURL
+	}
+
+	if strings.Contains(destinationURL, "?") {
+		return destinationURL + "&" + query
+	}
+
+	return destinationURL + "?" + query
+}
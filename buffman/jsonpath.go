@@ -0,0 +1,58 @@
+package buffman
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// lookupJSONPath walks a decoded JSON document following a dot separated path
+// of object keys, e.g. "result.token".
+func lookupJSONPath(doc any, path string) (any, bool) {
+	current := doc
+
+	for _, key := range strings.Split(path, ".") {
+		obj, isObj := current.(map[string]any)
+		if !isObj {
+			return nil, false
+		}
+
+		next, found := obj[key]
+		if !found {
+			return nil, false
+		}
+		current = next
+	}
+
+	return current, true
+}
+
+// lookupJSONPathString reads the value at path in a JSON payload as a string,
+// numbers and other scalars are returned in their JSON form.
+func lookupJSONPathString(payload []byte, path string) (string, bool) {
+	var doc any
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	if decoder.Decode(&doc) != nil {
+		return "", false
+	}
+
+	val, found := lookupJSONPath(doc, path)
+	if !found || val == nil {
+		return "", false
+	}
+
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,126 @@
+package buffman
+
+import (
+	"context"
+
+	"github.com/mse99/buffman/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_queued_total",
+		Help: "Requests accepted into the backlog.",
+	}, []string{"destination"})
+	requestsDispatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_dispatched_total",
+		Help: "Requests successfully delivered upstream.",
+	}, []string{"destination"})
+	requestsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_failed_total",
+		Help: "Failed dispatch attempts.",
+	}, []string{"destination"})
+	requestsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_dropped_total",
+		Help: "Requests moved out of the backlog to the dead letters.",
+	}, []string{"destination"})
+
+	requestsUndecryptable = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_undecryptable_total",
+		Help: "Leased requests held back because their payload can't be decrypted.",
+	}, []string{"destination"})
+
+	requestsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_rejected_total",
+		Help: "Inbound requests turned away because the backlog was full.",
+	}, []string{"destination"})
+	requestsEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_requests_evicted_total",
+		Help: "Requests dropped from a full backlog to make room for new ones.",
+	}, []string{"destination"})
+
+	dispatchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "buffman_dispatch_duration_seconds",
+		Help:    "Latency of upstream dispatch calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"destination"})
+	loginDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "buffman_login_duration_seconds",
+		Help:    "Latency of upstream login calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"destination"})
+
+	backlogSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "buffman_backlog_size",
+		Help: "Requests waiting in the backlog.",
+	}, []string{"destination"})
+	backlogOldestAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "buffman_backlog_oldest_request_age_seconds",
+		Help: "Age of the oldest request waiting in the backlog.",
+	}, []string{"destination"})
+
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "buffman_circuit_breaker_state",
+		Help: "State of the circuit breaker of a destination, 0 closed, 1 open and 2 half-open.",
+	}, []string{"destination"})
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_circuit_breaker_transitions_total",
+		Help: "Circuit breaker state changes by the state entered.",
+	}, []string{"destination", "state"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "buffman_token_refreshes_total",
+		Help: "Upstream token refreshes by result.",
+	}, []string{"destination", "result"})
+)
+
+var breakerStateValues = map[string]float64{
+	BreakerClosed:   0,
+	BreakerOpen:     1,
+	BreakerHalfOpen: 2,
+}
+
+func observeTokenRefresh(destination string, err error) {
+	if err != nil {
+		tokenRefreshes.WithLabelValues(destination, "failure").Inc()
+	} else {
+		tokenRefreshes.WithLabelValues(destination, "success").Inc()
+	}
+}
+
+// updateBacklogGauges refreshes the backlog size and oldest request age gauges
+// of every destination.
+func updateBacklogGauges(ctx context.Context, store Store) error {
+	stats, err := store.BacklogStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	sizes := map[string]float64{}
+	ages := map[string]float64{}
+
+	for _, stat := range stats {
+		name := stat.Destination
+		if name == "" {
+			name = config.GetDefaultDestination()
+		}
+
+		sizes[name] += float64(stat.Size)
+		ages[name] = max(ages[name], stat.OldestAge.Seconds())
+	}
+
+	// destinations that drained their backlog report zeros instead of stale values
+	for _, dest := range config.GetDestinations() {
+		if _, found := sizes[dest.Name]; !found {
+			sizes[dest.Name] = 0
+		}
+	}
+
+	for name, size := range sizes {
+		backlogSize.WithLabelValues(name).Set(size)
+		backlogOldestAge.WithLabelValues(name).Set(ages[name])
+	}
+
+	return nil
+}
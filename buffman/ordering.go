@@ -0,0 +1,22 @@
+package buffman
+
+import "github.com/mse99/buffman/config"
+
+// extractOrderingKey finds the key that orders an inbound request relative to
+// the other requests of its destination, the header wins over the JSON path.
+// Requests without a key are all sent in order with each other.
+func extractOrderingKey(cfg config.OrderingKeyConfig, in Inbound) string {
+	if cfg.Header != "" {
+		if key := in.Headers.Get(cfg.Header); key != "" {
+			return key
+		}
+	}
+
+	if cfg.JSONPath != "" {
+		if key, found := lookupJSONPathString(in.Payload, cfg.JSONPath); found {
+			return key
+		}
+	}
+
+	return ""
+}
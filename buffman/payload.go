@@ -0,0 +1,38 @@
+package buffman
+
+// storedPayload is a payload the way it is written to the database, first
+// compressed and then encrypted.
+type storedPayload struct {
+	data        []byte
+	compression string
+	keyId       string
+	wrappedKey  []byte
+}
+
+func packPayload(payload []byte) (storedPayload, error) {
+	compressed, compression, compressErr := compressPayload(payload)
+	if compressErr != nil {
+		return storedPayload{}, compressErr
+	}
+
+	sealed, keyId, wrappedKey, encryptErr := encryptPayload(compressed)
+	if encryptErr != nil {
+		return storedPayload{}, encryptErr
+	}
+
+	return storedPayload{
+		data:        sealed,
+		compression: compression,
+		keyId:       keyId,
+		wrappedKey:  wrappedKey,
+	}, nil
+}
+
+func (stored storedPayload) unpack() ([]byte, error) {
+	decrypted, decryptErr := decryptPayload(stored.data, stored.keyId, stored.wrappedKey)
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
+
+	return decompressPayload(decrypted, stored.compression)
+}
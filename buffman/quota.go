@@ -0,0 +1,153 @@
+package buffman
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+// ErrBacklogFull is returned when a request would take the backlog over
+// config.MaxBacklogSize or config.MaxBacklogBytes.
+var ErrBacklogFull = errors.New("backlog is full")
+
+// quotaEnforced tells whether the backlog has a limit.
+func quotaEnforced() bool {
+	return config.MaxBacklogSize > 0 || config.MaxBacklogBytes > 0
+}
+
+// enforceBacklogQuota checks the backlog against its limits once req was
+// inserted in tx, evicting its oldest requests under the drop-oldest policy
+// and otherwise rejecting req with ErrBacklogFull. The usage counters of each
+// destination are kept by triggers, Enqueue takes the quota lock of the
+// dialect beforehand so requests to different destinations are still checked
+// one after the other.
+func (s *sqlStore) enforceBacklogQuota(ctx context.Context, tx *sql.Tx, req Request) error {
+	if !quotaEnforced() {
+		return nil
+	}
+
+	requests, bytes, err := s.backlogUsage(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	excessRequests, excessBytes := 0, int64(0)
+	if config.MaxBacklogSize > 0 {
+		excessRequests = max(requests-config.MaxBacklogSize, 0)
+	}
+	if config.MaxBacklogBytes > 0 {
+		excessBytes = max(bytes-config.MaxBacklogBytes, 0)
+	}
+
+	if excessRequests == 0 && excessBytes == 0 {
+		return nil
+	}
+
+	if config.BacklogFullPolicy != config.BacklogFullDropOldest {
+		requestsRejected.WithLabelValues(req.Destination).Inc()
+		return ErrBacklogFull
+	}
+
+	evicted, freed, evictErr := s.evictOldest(ctx, tx, req.Id, excessRequests, excessBytes)
+	if evictErr != nil {
+		return evictErr
+	}
+
+	total := 0
+	for _, count := range evicted {
+		total += count
+	}
+
+	// leased requests can't be dropped, when they are all that's left the
+	// backlog stays full
+	if total < excessRequests || freed < excessBytes {
+		requestsRejected.WithLabelValues(req.Destination).Inc()
+		return ErrBacklogFull
+	}
+
+	for name, count := range evicted {
+		log.Printf("backlog is full, dropped the %d oldest requests of %s", count, name)
+		requestsEvicted.WithLabelValues(name).Add(float64(count))
+	}
+
+	return nil
+}
+
+func (s *sqlStore) BacklogUsage(ctx context.Context) (int, int64, error) {
+	return s.backlogUsage(ctx, s.db)
+}
+
+func (s *sqlStore) backlogUsage(ctx context.Context, db querier) (int, int64, error) {
+	var (
+		requests int
+		bytes    int64
+	)
+
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(requests), 0), COALESCE(SUM(bytes), 0) FROM BacklogUsage`).Scan(&requests, &bytes)
+
+	return requests, bytes, err
+}
+
+// evictOldest deletes the oldest requests that aren't leased, other than keep,
+// until count requests and size bytes of payload are gone or none are left. It
+// returns how many requests were deleted per destination and the bytes freed.
+func (s *sqlStore) evictOldest(ctx context.Context, tx *sql.Tx, keep int, count int, size int64) (map[string]int, int64, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT id, COALESCE(destination, ''), COALESCE(LENGTH(payload), 0) FROM RequestsBacklog
+		WHERE (leaseUntil IS NULL OR leaseUntil <= @now) AND id <> @keep
+		ORDER BY createdOn ASC, id ASC`,
+		s.args(
+			sql.Named("now", time.Now().UTC()),
+			sql.Named("keep", keep),
+		)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	type victim struct {
+		id          int
+		destination string
+	}
+
+	victims := []victim{}
+	freed := int64(0)
+
+	for (len(victims) < count || freed < size) && rows.Next() {
+		var (
+			v      victim
+			length int64
+		)
+
+		scanErr := rows.Scan(&v.id, &v.destination, &length)
+		if scanErr != nil {
+			return nil, 0, scanErr
+		}
+
+		victims = append(victims, v)
+		freed += length
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, 0, rowsErr
+	}
+	rows.Close()
+
+	evicted := map[string]int{}
+
+	for _, v := range victims {
+		_, deleteErr := tx.ExecContext(ctx, `DELETE FROM RequestsBacklog WHERE id = @id`, s.args(sql.Named("id", v.id))...)
+		if deleteErr != nil {
+			return nil, 0, deleteErr
+		}
+
+		evicted[v.destination]++
+	}
+
+	return evicted, freed, nil
+}
@@ -0,0 +1,170 @@
+package buffman
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestBacklogQuota(t *testing.T) {
+	t.Cleanup(func() {
+		config.MaxBacklogSize = 0
+		config.MaxBacklogBytes = 0
+		config.BacklogFullPolicy = ""
+	})
+
+	enqueue := func(store Store, payload string) (Request, error) {
+		return store.Enqueue(ctx, Request{Destination: "fma", Payload: []byte(payload), CreatedOn: time.Now()})
+	}
+
+	seed := func(t *testing.T, store Store, payloads ...string) []Request {
+		requests := []Request{}
+		for _, payload := range payloads {
+			req, err := enqueue(store, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests = append(requests, req)
+		}
+
+		return requests
+	}
+
+	t.Run("requests over the limits are rejected", func(t *testing.T) {
+		config.MaxBacklogSize = 2
+		config.MaxBacklogBytes = 0
+		config.BacklogFullPolicy = config.BacklogFullReject503
+
+		store := createTestStore(t)
+		seed(t, store, "a", "b")
+
+		_, err := enqueue(store, "c")
+		if !errors.Is(err, ErrBacklogFull) {
+			t.Errorf("expected ErrBacklogFull but got %v", err)
+		}
+
+		config.MaxBacklogSize = 0
+		config.MaxBacklogBytes = 10
+
+		if _, err := enqueue(store, "xxxxxxxxx"); !errors.Is(err, ErrBacklogFull) {
+			t.Errorf("expected no room for 9 bytes but got %v", err)
+		}
+		if _, err := enqueue(store, "xxxxxxxx"); err != nil {
+			t.Errorf("expected room for 8 bytes but got %v", err)
+		}
+
+		size, bytes, err := store.BacklogUsage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if size != 3 || bytes != 10 {
+			t.Errorf("expected the rejected requests to be left out but got %d requests taking %d bytes", size, bytes)
+		}
+	})
+
+	t.Run("the oldest requests make room under drop-oldest", func(t *testing.T) {
+		config.MaxBacklogSize = 0
+		config.MaxBacklogBytes = 8
+		config.BacklogFullPolicy = config.BacklogFullDropOldest
+
+		store := createTestStore(t)
+		seeded := seed(t, store, "aaaa", "bbbb")
+
+		newest, err := enqueue(store, "ccc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remaining, _, err := store.ListRequests(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if !slices.Equal(requestIds(remaining...), requestIds(seeded[1], newest)) {
+			t.Errorf("expected only the newest requests to be left but got %v", requestIds(remaining...))
+		}
+	})
+
+	t.Run("leased requests are never dropped", func(t *testing.T) {
+		config.MaxBacklogSize = 1
+		config.MaxBacklogBytes = 0
+		config.BacklogFullPolicy = config.BacklogFullDropOldest
+
+		store := createTestStore(t)
+		seed(t, store, "a")
+
+		if _, err := store.Lease(ctx, "tests", time.Minute, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := enqueue(store, "b")
+		if !errors.Is(err, ErrBacklogFull) {
+			t.Errorf("expected ErrBacklogFull but got %v", err)
+		}
+	})
+
+	t.Run("usage follows the requests leaving the backlog", func(t *testing.T) {
+		config.MaxBacklogSize = 0
+		config.MaxBacklogBytes = 0
+
+		store := createTestStore(t)
+		seeded := seed(t, store, "aaaa", "bb", "c")
+		leaseAll(t, store)
+
+		if err := store.Ack(ctx, "tests", seeded[0].Id); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeadLetter(ctx, "tests", seeded[1].Id, 500, errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+
+		size, bytes, err := store.BacklogUsage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if size != 1 || bytes != 1 {
+			t.Errorf("expected 1 request taking 1 byte but got %d taking %d", size, bytes)
+		}
+	})
+
+	t.Run("usage is counted per destination", func(t *testing.T) {
+		config.MaxBacklogSize = 3
+		config.MaxBacklogBytes = 0
+		config.BacklogFullPolicy = config.BacklogFullReject503
+
+		store := createTestStore(t)
+		seed(t, store, "aa")
+
+		_, err := store.Enqueue(ctx, Request{Destination: "erp", Payload: []byte("bbb"), CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// requests queued before destinations existed move to the one
+		// adopting them
+		_, err = store.db.ExecContext(ctx, `INSERT INTO RequestsBacklog (payload, createdOn) VALUES ('c', @createdOn)`, sql.Named("createdOn", time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AdoptUnassigned(ctx, "erp"); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := store.BacklogStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sizes := map[string]int{}
+		for _, stat := range stats {
+			sizes[stat.Destination] = stat.Size
+		}
+		if len(sizes) != 2 || sizes["fma"] != 1 || sizes["erp"] != 2 {
+			t.Errorf("expected 1 request for fma and 2 for erp but got %v", sizes)
+		}
+
+		if _, err := enqueue(store, "d"); !errors.Is(err, ErrBacklogFull) {
+			t.Errorf("expected the limit to cover every destination but got %v", err)
+		}
+	})
+}
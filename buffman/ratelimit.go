@@ -0,0 +1,105 @@
+package buffman
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mse99/buffman/config"
+	"golang.org/x/time/rate"
+)
+
+// throttle paces the calls made to a destination with a token bucket and
+// pauses them when the destination asks for it with Retry-After.
+type throttle struct {
+	destination string
+	limiter     *rate.Limiter
+
+	lock        sync.Mutex
+	pausedUntil time.Time
+}
+
+func newThrottle(destination string, cfg config.RateLimitConfig) *throttle {
+	t := &throttle{destination: destination}
+
+	cfg = cfg.Resolve()
+	if cfg.RequestsPerSecond > 0 {
+		t.limiter = rate.NewLimiter(rate.Limit(cfg.RequestsPerSecond), cfg.Burst)
+	}
+
+	return t
+}
+
+// wait blocks until the token bucket lets a call through.
+func (t *throttle) wait(ctx context.Context) error {
+	if t == nil || t.limiter == nil {
+		return nil
+	}
+
+	return t.limiter.Wait(ctx)
+}
+
+// paused tells whether the destination asked not to be called for now, and
+// until when.
+func (t *throttle) paused() (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.pausedUntil, time.Now().Before(t.pausedUntil)
+}
+
+// observe pauses the destination until the time given by the Retry-After
+// header of 429 and 503 responses.
+func (t *throttle) observe(res *http.Response) {
+	if t == nil {
+		return
+	}
+
+	until, found := retryAfter(res.StatusCode, res.Header, time.Now())
+	if !found {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if until.After(t.pausedUntil) {
+		log.Printf("%s asked to retry after %s, pausing its dispatch", t.destination, until.Format(time.RFC3339))
+		t.pausedUntil = until
+	}
+}
+
+// retryAfter returns the time a 429 or 503 response asked to be retried at.
+func retryAfter(status int, headers http.Header, now time.Time) (time.Time, bool) {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+
+	return parseRetryAfter(headers.Get("Retry-After"), now)
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an
+// HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Time, bool) {
+	if header == "" {
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return now.Add(time.Duration(max(seconds, 0)) * time.Second), true
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return date, true
+}
@@ -0,0 +1,90 @@
+package buffman
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func TestThrottle(t *testing.T) {
+	t.Run("calls are paced by the token bucket", func(t *testing.T) {
+		throttle := newThrottle("fma", config.RateLimitConfig{RequestsPerSecond: 20, Burst: 1})
+
+		start := time.Now()
+		for range 3 {
+			if err := throttle.wait(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if elapsed := time.Since(start); elapsed < time.Millisecond*90 {
+			t.Errorf("expected 3 calls at 20/s to take about 100ms but took %s", elapsed)
+		}
+	})
+
+	t.Run("reading Retry-After", func(t *testing.T) {
+		now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+		until, found := parseRetryAfter("120", now)
+		if !found || !until.Equal(now.Add(time.Minute*2)) {
+			t.Errorf("expected a pause of 2 minutes but got %s", until)
+		}
+
+		until, found = parseRetryAfter("Wed, 01 Jan 2025 10:05:00 GMT", now)
+		if !found || !until.Equal(now.Add(time.Minute*5)) {
+			t.Errorf("expected a pause until 10:05 but got %s", until)
+		}
+
+		if _, found = parseRetryAfter("soon", now); found {
+			t.Error("expected an invalid header to be ignored")
+		}
+	})
+
+	t.Run("a 429 pauses the destination", func(t *testing.T) {
+		calls := 0
+		server := createTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+
+		store := createTestStore(t)
+		dest := &destination{
+			Destination: config.Destination{Name: "fma", URL: server.URL},
+			auth:        noAuth{},
+			throttle:    newThrottle("fma", config.RateLimitConfig{}),
+		}
+		opts := requestProcessingOpts{store: store, owner: "tests", destinations: map[string]*destination{"fma": dest}}
+
+		for _, key := range []string{"a", "b"} {
+			_, err := store.Enqueue(ctx, Request{Destination: "fma", OrderingKey: key, Payload: []byte("{}"), CreatedOn: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		group := leaseAll(t, store)
+
+		dispatchGroup(ctx, opts, group[:1])
+		dispatchGroup(ctx, opts, group[1:])
+
+		if _, paused := dest.throttle.paused(); calls != 1 || !paused {
+			t.Errorf("expected the destination to be paused after a single call but got %d calls", calls)
+		}
+
+		postponed, err := store.GetRequest(ctx, group[0].Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if postponed.Attempts != 0 || postponed.LastStatus != http.StatusTooManyRequests || postponed.NextAttemptAt.Before(time.Now().Add(time.Second*55)) {
+			t.Errorf("expected the limited request to wait for Retry-After without using an attempt but got %+v", postponed)
+		}
+
+		held, err := store.GetRequest(ctx, group[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if held.Attempts != 0 || held.ClaimedBy != "" || held.NextAttemptAt.Before(time.Now().Add(time.Second*55)) {
+			t.Errorf("expected the held back request to wait for the pause without using an attempt but got %+v", held)
+		}
+	})
+}
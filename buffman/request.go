@@ -3,60 +3,707 @@ package buffman
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/mse99/buffman/config"
 )
 
 type Request struct {
-	Id        int       `json:"id"`
-	Payload   string    `json:"string"`
-	CreatedOn time.Time `json:"createdOn"`
+	Id             int         `json:"id"`
+	Destination    string      `json:"destination"`
+	OrderingKey    string      `json:"orderingKey"`
+	IdempotencyKey string      `json:"idempotencyKey"`
+	Method         string      `json:"method"`
+	Headers        http.Header `json:"headers"`
+	Query          string      `json:"query"`
+	ContentType    string      `json:"contentType"`
+
+	// ContentEncoding is the Content-Encoding the payload was received with,
+	// it is stored and replayed as is.
+	ContentEncoding string    `json:"contentEncoding"`
+	Payload         []byte    `json:"payload"`
+	CreatedOn       time.Time `json:"createdOn"`
+	Attempts        int       `json:"attempts"`
+	NextAttemptAt   time.Time `json:"nextAttemptAt"`
+	LastError       string    `json:"lastError"`
+	LastStatus      int       `json:"lastStatus"`
+
+	// ClaimedBy is the instance dispatching the request until LeaseUntil,
+	// other instances leave it alone until then.
+	ClaimedBy  string    `json:"claimedBy"`
+	LeaseUntil time.Time `json:"leaseUntil"`
+
+	// ApiKey is the name of the API key the request was queued with.
+	ApiKey string `json:"apiKey"`
 }
 
-func deleteRequestByID(ctx context.Context, db *sql.DB, id int) error {
-	_, err := db.ExecContext(ctx, `DELETE FROM RequestsBacklog WHERE id = @id`, sql.Named("id", id))
-	return err
+// ErrNotFound is returned when a request or dead letter does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrLeaseLost is returned when acking, nacking or releasing a request that is
+// no longer leased by the caller, its lease expired and another owner took
+// it over or it was removed in the meantime.
+var ErrLeaseLost = errors.New("lease was lost")
+
+// ErrLeased is returned when an operator changes a request an instance holds a
+// lease on.
+var ErrLeased = errors.New("request is leased")
+
+// ListOptions paginates and filters the requests and dead letters listings,
+// zero values leave the matching filter out.
+type ListOptions struct {
+	Limit         int
+	Offset        int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	MinAttempts   int
+	Destination   string
 }
 
-func insertRequest(ctx context.Context, db *sql.DB, req Request) (Request, error) {
-	row := db.QueryRowContext(
-		ctx,
-		`INSERT INTO RequestsBacklog (payload, createdOn) VALUES (@payload, @createdOn) RETURNING id, payload, createdOn`,
-		sql.Named("payload", req.Payload),
-		sql.Named("createdOn", req.CreatedOn),
+func (opts ListOptions) args() []sql.NamedArg {
+	return []sql.NamedArg{
+		sql.Named("limit", sqlLimit(opts.Limit)),
+		sql.Named("offset", opts.Offset),
+		sql.Named("createdAfter", nullableTime(opts.CreatedAfter)),
+		sql.Named("createdBefore", nullableTime(opts.CreatedBefore)),
+		sql.Named("minAttempts", opts.MinAttempts),
+		sql.Named("destination", opts.Destination),
+	}
+}
+
+// sqlLimit turns limits of 0 or less, which mean no limit, into the -1 the
+// dialects expect.
+func sqlLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+func nullableTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+const requestColumns = `id, destination, orderingKey, idempotencyKey, method, headers, query, contentType, contentEncoding, compression, keyId, wrappedKey, payload, createdOn, attempts, nextAttemptAt, lastError, lastStatus, claimedBy, leaseUntil, apiKey`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRequest(row scanner) (Request, error) {
+	var (
+		req             Request
+		destination     sql.NullString
+		orderingKey     sql.NullString
+		idempotencyKey  sql.NullString
+		method          sql.NullString
+		headers         sql.NullString
+		query           sql.NullString
+		contentType     sql.NullString
+		contentEncoding sql.NullString
+		compression     sql.NullString
+		keyId           sql.NullString
+		stored          storedPayload
+		nextAttemptAt   sql.NullTime
+		lastError       sql.NullString
+		lastStatus      sql.NullInt64
+		claimedBy       sql.NullString
+		leaseUntil      sql.NullTime
+		apiKey          sql.NullString
 	)
 
 	scanErr := row.Scan(
 		&req.Id,
-		&req.Payload,
+		&destination,
+		&orderingKey,
+		&idempotencyKey,
+		&method,
+		&headers,
+		&query,
+		&contentType,
+		&contentEncoding,
+		&compression,
+		&keyId,
+		&stored.wrappedKey,
+		&stored.data,
 		&req.CreatedOn,
+		&req.Attempts,
+		&nextAttemptAt,
+		&lastError,
+		&lastStatus,
+		&claimedBy,
+		&leaseUntil,
+		&apiKey,
+	)
+	if scanErr != nil {
+		return req, scanErr
+	}
+
+	// requests queued before destinations existed belong to the default one
+	req.Destination = destination.String
+	req.OrderingKey = orderingKey.String
+	req.IdempotencyKey = idempotencyKey.String
+	req.Query = query.String
+
+	// requests queued before their method and content type were kept were
+	// all JSON posted by Odoo
+	req.Method = method.String
+	if req.Method == "" {
+		req.Method = http.MethodPost
+	}
+	req.ContentType = contentType.String
+	if !contentType.Valid {
+		req.ContentType = defaultContentType
+	}
+	req.ContentEncoding = contentEncoding.String
+
+	stored.compression = compression.String
+	stored.keyId = keyId.String
+
+	if headers.Valid {
+		headersErr := json.Unmarshal([]byte(headers.String), &req.Headers)
+		if headersErr != nil {
+			return req, headersErr
+		}
+	}
+	if req.Destination == "" {
+		req.Destination = config.GetDefaultDestination()
+	}
+
+	// requests that were never attempted are due from the moment they were queued
+	req.NextAttemptAt = req.CreatedOn
+	if nextAttemptAt.Valid {
+		req.NextAttemptAt = nextAttemptAt.Time
+	}
+	req.LastError = lastError.String
+	req.LastStatus = int(lastStatus.Int64)
+	req.ClaimedBy = claimedBy.String
+	req.LeaseUntil = leaseUntil.Time
+	req.ApiKey = apiKey.String
+
+	// the payload is unpacked last so undecryptable requests still come with
+	// the rest of their columns
+	payload, unpackErr := stored.unpack()
+	if unpackErr != nil {
+		return req, fmt.Errorf("request %d: %w", req.Id, unpackErr)
+	}
+	req.Payload = payload
+
+	return req, nil
+}
+
+func (s *sqlStore) Ack(ctx context.Context, owner string, id int) error {
+	res, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM RequestsBacklog WHERE id = @id AND claimedBy = @owner`,
+		s.args(sql.Named("id", id), sql.Named("owner", owner))...,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectLeased(res)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlStore) Enqueue(ctx context.Context, req Request) (Request, error) {
+	if req.Destination == "" {
+		req.Destination = config.GetDefaultDestination()
+	}
+
+	tx, txErr := s.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return req, txErr
+	}
+	defer tx.Rollback()
+
+	if quotaEnforced() && s.dialect.lockQuota != "" {
+		_, lockErr := tx.ExecContext(ctx, s.dialect.lockQuota)
+		if lockErr != nil {
+			return req, lockErr
+		}
+	}
+
+	if req.IdempotencyKey != "" {
+		claimErr := s.claimIdempotencyKey(ctx, tx, req.Destination, req.IdempotencyKey, req.CreatedOn)
+		if claimErr != nil {
+			return req, claimErr
+		}
+	}
+
+	inserted, err := s.insertRequest(ctx, tx, req)
+	if err != nil {
+		return inserted, err
+	}
+
+	quotaErr := s.enforceBacklogQuota(ctx, tx, inserted)
+	if quotaErr != nil {
+		return inserted, quotaErr
+	}
+
+	if req.IdempotencyKey != "" {
+		_, linkErr := tx.ExecContext(
+			ctx,
+			`UPDATE IdempotencyKeys SET requestId = @requestId WHERE destination = @destination AND key = @key`,
+			s.args(
+				sql.Named("requestId", inserted.Id),
+				sql.Named("destination", req.Destination),
+				sql.Named("key", req.IdempotencyKey),
+			)...,
+		)
+		if linkErr != nil {
+			return inserted, linkErr
+		}
+	}
+
+	return inserted, tx.Commit()
+}
+
+func (s *sqlStore) insertRequest(ctx context.Context, db querier, req Request) (Request, error) {
+	var headers any
+	if len(req.Headers) > 0 {
+		headersBytes, headersErr := json.Marshal(req.Headers)
+		if headersErr != nil {
+			return req, headersErr
+		}
+		headers = string(headersBytes)
+	}
+
+	stored, packErr := packPayload(req.Payload)
+	if packErr != nil {
+		return req, packErr
+	}
+
+	row := db.QueryRowContext(
+		ctx,
+		`INSERT INTO RequestsBacklog (destination, orderingKey, idempotencyKey, method, headers, query, contentType, contentEncoding, compression, keyId, wrappedKey, payload, createdOn, attempts, apiKey)
+		VALUES (@destination, @orderingKey, @idempotencyKey, @method, @headers, @query, @contentType, @contentEncoding, @compression, @keyId, @wrappedKey, @payload, @createdOn, @attempts, @apiKey)
+		RETURNING `+requestColumns,
+		s.args(
+			sql.Named("destination", req.Destination),
+			sql.Named("orderingKey", req.OrderingKey),
+			sql.Named("idempotencyKey", nullableString(req.IdempotencyKey)),
+			sql.Named("method", nullableString(req.Method)),
+			sql.Named("headers", headers),
+			sql.Named("query", nullableString(req.Query)),
+			// an empty content type is kept apart from the NULL of rows
+			// queued before it was stored
+			sql.Named("contentType", req.ContentType),
+			sql.Named("contentEncoding", nullableString(req.ContentEncoding)),
+			sql.Named("compression", nullableString(stored.compression)),
+			sql.Named("keyId", nullableString(stored.keyId)),
+			sql.Named("wrappedKey", stored.wrappedKey),
+			sql.Named("payload", stored.data),
+			sql.Named("createdOn", req.CreatedOn),
+			sql.Named("attempts", req.Attempts),
+			sql.Named("apiKey", nullableString(req.ApiKey)),
+		)...,
+	)
+
+	return scanRequest(row)
+}
+
+func (s *sqlStore) Nack(ctx context.Context, owner string, id int, nextAttemptAt time.Time, lastStatus int, lastErr error) (int, error) {
+	row := s.db.QueryRowContext(
+		ctx,
+		`UPDATE RequestsBacklog
+		SET attempts = attempts + 1, nextAttemptAt = @nextAttemptAt, lastError = @lastError, lastStatus = @lastStatus,
+			claimedBy = NULL, leaseUntil = NULL
+		WHERE id = @id AND claimedBy = @owner
+		RETURNING attempts`,
+		s.args(
+			sql.Named("id", id),
+			sql.Named("owner", owner),
+			sql.Named("nextAttemptAt", nextAttemptAt.UTC()),
+			sql.Named("lastError", lastErr.Error()),
+			sql.Named("lastStatus", lastStatus),
+		)...,
+	)
+
+	var attempts int
+	scanErr := row.Scan(&attempts)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		return 0, ErrLeaseLost
+	}
+
+	return attempts, scanErr
+}
+
+func (s *sqlStore) Postpone(ctx context.Context, owner string, id int, nextAttemptAt time.Time, lastStatus int, lastErr error) error {
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE RequestsBacklog
+		SET nextAttemptAt = @nextAttemptAt, lastError = @lastError, lastStatus = @lastStatus,
+			claimedBy = NULL, leaseUntil = NULL
+		WHERE id = @id AND claimedBy = @owner`,
+		s.args(
+			sql.Named("id", id),
+			sql.Named("owner", owner),
+			sql.Named("nextAttemptAt", nextAttemptAt.UTC()),
+			sql.Named("lastError", lastErr.Error()),
+			sql.Named("lastStatus", lastStatus),
+		)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectLeased(res)
+}
+
+func (s *sqlStore) Extend(ctx context.Context, owner string, ids []int, leaseFor time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	named := []sql.NamedArg{
+		sql.Named("owner", owner),
+		sql.Named("leaseUntil", time.Now().Add(leaseFor).UTC()),
+	}
+	params := []string{}
+	for i, id := range ids {
+		name := fmt.Sprintf("id%d", i)
+		named = append(named, sql.Named(name, id))
+		params = append(params, "@"+name)
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE RequestsBacklog SET leaseUntil = @leaseUntil WHERE claimedBy = @owner AND id IN (`+strings.Join(params, ", ")+`)`,
+		s.args(named...)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, affectedErr := res.RowsAffected()
+	if affectedErr != nil {
+		return affectedErr
+	} else if affected < int64(len(ids)) {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Release(ctx context.Context, owner string, id int) error {
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE RequestsBacklog SET claimedBy = NULL, leaseUntil = NULL WHERE id = @id AND claimedBy = @owner`,
+		s.args(sql.Named("id", id), sql.Named("owner", owner))...,
 	)
+	if err != nil {
+		return err
+	}
 
-	return req, scanErr
+	return expectLeased(res)
 }
 
-func loadUnfinishedRequests(ctx context.Context, db *sql.DB) ([]Request, error) {
-	rows, err := db.QueryContext(ctx, `SELECT id, payload, createdOn FROM RequestsBacklog ORDER BY createdOn ASC`)
+func (s *sqlStore) Hold(ctx context.Context, owner string, id int, nextAttemptAt time.Time) error {
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE RequestsBacklog SET nextAttemptAt = @nextAttemptAt, claimedBy = NULL, leaseUntil = NULL WHERE id = @id AND claimedBy = @owner`,
+		s.args(
+			sql.Named("id", id),
+			sql.Named("owner", owner),
+			sql.Named("nextAttemptAt", nextAttemptAt.UTC()),
+		)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectLeased(res)
+}
+
+// expectLeased turns an update of a request that matched no row into
+// ErrLeaseLost.
+func expectLeased(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// Lease claims the oldest requests whose backoff window has elapsed and that
+// no other instance holds a lease on, until leaseFor has passed. Requests
+// queued after one that another owner holds a lease on for the same
+// destination and ordering key are held back as well so they are not sent out
+// of order, and unless config.ContinueOnError is set so are those queued after
+// one that is still backing off. The destination and
+// ordering key are compared as they are, so the check can use their index,
+// rows are never left without them once AdoptUnassigned has run.
+func (s *sqlStore) Lease(ctx context.Context, owner string, leaseFor time.Duration, limit int) ([]Request, error) {
+	now := time.Now().UTC()
+
+	tx, txErr := s.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	if s.dialect.lockLease != "" {
+		_, lockErr := tx.ExecContext(ctx, s.dialect.lockLease)
+		if lockErr != nil {
+			return nil, lockErr
+		}
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`UPDATE RequestsBacklog SET claimedBy = @owner, leaseUntil = @leaseUntil
+		WHERE id IN (
+			SELECT due.id FROM RequestsBacklog AS due
+			WHERE (due.nextAttemptAt IS NULL OR due.nextAttemptAt <= @now)
+			AND (due.leaseUntil IS NULL OR due.leaseUntil <= @now)
+			AND NOT EXISTS (
+				SELECT 1 FROM RequestsBacklog AS blocked
+				WHERE (
+					(blocked.leaseUntil > @now AND blocked.claimedBy <> @owner)
+					OR (@ordered AND (blocked.nextAttemptAt > @now OR blocked.leaseUntil > @now))
+				)
+				AND blocked.createdOn <= due.createdOn
+				AND blocked.destination = due.destination
+				AND blocked.orderingKey = due.orderingKey
+			)
+			ORDER BY due.createdOn ASC `+s.dialect.limit+` `+s.dialect.lockDue+`
+		)
+		RETURNING `+requestColumns,
+		s.args(
+			sql.Named("owner", owner),
+			sql.Named("leaseUntil", now.Add(leaseFor)),
+			sql.Named("now", now),
+			sql.Named("ordered", !config.ContinueOnError),
+			sql.Named("limit", sqlLimit(limit)),
+		)...,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	results := []Request{}
+	undecryptable := []Request{}
+	decryptErrs := []error{}
 
 	for rows.Next() {
-		req := Request{}
-
-		scanErr := rows.Scan(
-			&req.Id,
-			&req.Payload,
-			&req.CreatedOn,
-		)
-		if scanErr != nil {
+		req, scanErr := scanRequest(rows)
+		if errors.Is(scanErr, ErrUndecryptable) {
+			undecryptable = append(undecryptable, req)
+			decryptErrs = append(decryptErrs, scanErr)
+			continue
+		} else if scanErr != nil {
 			return nil, scanErr
 		}
 
 		results = append(results, req)
 	}
+	rows.Close()
+
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		return nil, commitErr
+	}
+
+	// RETURNING doesn't keep the order of the subquery
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].CreatedOn.Equal(results[j].CreatedOn) {
+			return results[i].Id < results[j].Id
+		}
+		return results[i].CreatedOn.Before(results[j].CreatedOn)
+	})
+
+	// undecryptable requests wait in the backlog for their key to be restored
+	// or for an operator to dead letter them, holding back the requests
+	// queued after them so these aren't sent out of order
+	for i, req := range undecryptable {
+		log.Printf("holding back request %d: %v", req.Id, decryptErrs[i])
+
+		holdErr := s.holdUndecryptable(ctx, owner, req, decryptErrs[i])
+		if holdErr != nil {
+			return nil, holdErr
+		}
+		requestsUndecryptable.WithLabelValues(req.Destination).Inc()
+	}
+
+	if config.ContinueOnError || len(undecryptable) == 0 {
+		return results, nil
+	}
+
+	leased := []Request{}
+	for _, req := range results {
+		if !queuedAfterAny(req, undecryptable) {
+			leased = append(leased, req)
+			continue
+		}
+
+		releaseErr := s.Release(ctx, owner, req.Id)
+		if releaseErr != nil {
+			return nil, releaseErr
+		}
+	}
+
+	return leased, nil
+}
+
+// queuedAfterAny tells whether req was queued after one of others for the same
+// destination and ordering key.
+func queuedAfterAny(req Request, others []Request) bool {
+	return slices.ContainsFunc(others, func(other Request) bool {
+		return other.Destination == req.Destination &&
+			other.OrderingKey == req.OrderingKey &&
+			(other.CreatedOn.Before(req.CreatedOn) || other.CreatedOn.Equal(req.CreatedOn) && other.Id < req.Id)
+	})
+}
+
+// undecryptableRecheck is how long requests that can't be decrypted are held
+// back before their payload is tried again.
+const undecryptableRecheck = time.Minute
+
+// holdUndecryptable releases a request whose payload can't be decrypted until
+// undecryptableRecheck has passed, without counting it as an attempt.
+func (s *sqlStore) holdUndecryptable(ctx context.Context, owner string, req Request, decryptErr error) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE RequestsBacklog
+		SET nextAttemptAt = @nextAttemptAt, lastError = @lastError, claimedBy = NULL, leaseUntil = NULL
+		WHERE id = @id AND claimedBy = @owner`,
+		s.args(
+			sql.Named("id", req.Id),
+			sql.Named("owner", owner),
+			sql.Named("nextAttemptAt", time.Now().Add(undecryptableRecheck).UTC()),
+			sql.Named("lastError", decryptErr.Error()),
+		)...,
+	)
+
+	return err
+}
+
+// ListRequests returns a page of the queued requests matching opts, oldest
+// first, along with the total number of matching requests.
+func (s *sqlStore) ListRequests(ctx context.Context, opts ListOptions) ([]Request, int, error) {
+	var total int
+
+	countErr := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM RequestsBacklog WHERE `+s.dialect.listFilter, s.args(opts.args()...)...).Scan(&total)
+	if countErr != nil {
+		return nil, 0, countErr
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT `+requestColumns+` FROM RequestsBacklog WHERE `+s.dialect.listFilter+` ORDER BY createdOn ASC `+s.dialect.limit+` OFFSET @offset`,
+		s.args(opts.args()...)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []Request{}
+
+	for rows.Next() {
+		req, scanErr := scanRequest(rows)
+		if scanErr != nil && !errors.Is(scanErr, ErrUndecryptable) {
+			return nil, 0, scanErr
+		}
+
+		results = append(results, req)
+	}
+
+	return results, total, nil
+}
+
+func (s *sqlStore) GetRequest(ctx context.Context, id int) (Request, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+requestColumns+` FROM RequestsBacklog WHERE id = @id`, s.args(sql.Named("id", id))...)
+
+	req, err := scanRequest(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return req, ErrNotFound
+	} else if errors.Is(err, ErrUndecryptable) {
+		return req, nil
+	}
+
+	return req, err
+}
+
+func (s *sqlStore) RetryNow(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE RequestsBacklog SET nextAttemptAt = NULL WHERE id = @id`, s.args(sql.Named("id", id))...)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// RetryRequestNow clears the backoff of a request and wakes up the dispatcher.
+func RetryRequestNow(ctx context.Context, store Store, id int) error {
+	err := store.RetryNow(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	signalProcessing(ctx)
+	return nil
+}
+
+func (s *sqlStore) DeleteRequest(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM RequestsBacklog WHERE id = @id`, s.args(sql.Named("id", id))...)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+func expectAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *sqlStore) AdoptUnassigned(ctx context.Context, destination string) error {
+	for _, table := range []string{"RequestsBacklog", "DeadLetters"} {
+		_, err := s.db.ExecContext(
+			ctx,
+			`UPDATE `+table+` SET destination = @destination WHERE destination IS NULL OR destination = ''`,
+			s.args(sql.Named("destination", destination))...,
+		)
+		if err != nil {
+			return err
+		}
+	}
 
-	return results, nil
+	return nil
 }
@@ -1,18 +1,23 @@
 package buffman
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
+	"net/http"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/mse99/buffman/config"
 	"github.com/mse99/buffman/repos"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var ctx = context.Background()
 
-func connectToTestingDB(t *testing.T) *sql.DB {
+func connectToTestingStore(t *testing.T) *sqlStore {
 	db, err := repos.ConnectToDB(ctx, ":memory:")
 	if err != nil {
 		t.Fatal(err)
@@ -20,19 +25,37 @@ func connectToTestingDB(t *testing.T) *sql.DB {
 	t.Cleanup(func() {
 		db.Close()
 	})
-	return db
+	return &sqlStore{db: db, dialect: sqliteDialect}
+}
+
+// leaseAll leases every due request for the tests.
+func leaseAll(t *testing.T, store Store) []Request {
+	requests, err := store.Lease(ctx, "tests", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return requests
+}
+
+func requestIds(requests ...Request) []int {
+	ids := []int{}
+	for _, req := range requests {
+		ids = append(ids, req.Id)
+	}
+	return ids
 }
 
 func Test_Request(t *testing.T) {
 	t.Parallel()
 
 	t.Run("insertNewRequest should return a request with filled id field", func(t *testing.T) {
-		db := connectToTestingDB(t)
+		store := connectToTestingStore(t)
 
 		now := time.Now()
 
-		req, err := insertRequest(ctx, db, Request{
-			Payload:   "Hello world",
+		req, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("Hello world"),
 			CreatedOn: now,
 		})
 
@@ -40,17 +63,71 @@ func Test_Request(t *testing.T) {
 			t.Fatal(err)
 		} else if req.Id == 0 {
 			t.Error("did not auto increment id")
-		} else if req.Payload != "Hello world" {
+		} else if string(req.Payload) != "Hello world" {
 			t.Errorf("wrong payload stored %v", req.Payload)
 		} else if req.CreatedOn.UnixMilli() != now.UnixMilli() {
 			t.Errorf("wrong time stored %v", req.CreatedOn)
 		}
 	})
 
+	t.Run("binary payloads are stored untouched", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		payload := []byte{0x00, 0xff, 0x20, 0x20, 0xc3, 0x28, 0x0a}
+
+		req, err := store.Enqueue(ctx, Request{
+			Payload:         payload,
+			ContentType:     "application/x-protobuf",
+			ContentEncoding: "identity",
+			CreatedOn:       time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, getErr := store.GetRequest(ctx, req.Id)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+
+		if !bytes.Equal(stored.Payload, payload) {
+			t.Errorf("expected payload %v but got %v", payload, stored.Payload)
+		}
+		if stored.ContentType != "application/x-protobuf" || stored.ContentEncoding != "identity" {
+			t.Errorf("unexpected content type %s and encoding %s", stored.ContentType, stored.ContentEncoding)
+		}
+	})
+
+	t.Run("only legacy requests default to JSON", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		req, err := store.Enqueue(ctx, Request{Method: http.MethodGet, CreatedOn: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.db.ExecContext(ctx, `INSERT INTO RequestsBacklog (payload, createdOn) VALUES ('{}', @createdOn)`, sql.Named("createdOn", time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests := leaseAll(t, store)
+		if len(requests) != 2 {
+			t.Fatalf("expected both requests but got %v", requests)
+		}
+
+		if requests[0].Id != req.Id || requests[0].ContentType != "" {
+			t.Errorf("expected the request queued without a content type to keep it empty but got %q", requests[0].ContentType)
+		}
+		if requests[1].ContentType != defaultContentType || requests[1].Method != http.MethodPost {
+			t.Errorf("expected the legacy request to be JSON posted but got %s %q", requests[1].Method, requests[1].ContentType)
+		}
+	})
+
 	t.Run("loading unfinished requests with empty DB", func(t *testing.T) {
-		db := connectToTestingDB(t)
+		store := connectToTestingStore(t)
 
-		requests, err := loadUnfinishedRequests(ctx, db)
+		requests, err := store.Lease(ctx, "tests", 0, 0)
 		if err != nil {
 			t.Error(err)
 		} else if !reflect.DeepEqual(requests, []Request{}) {
@@ -59,83 +136,362 @@ func Test_Request(t *testing.T) {
 	})
 
 	t.Run("inserting and loading unfinished requests", func(t *testing.T) {
-		db := connectToTestingDB(t)
+		store := connectToTestingStore(t)
 
 		now := time.Now()
 
-		req1, err := insertRequest(ctx, db, Request{
-			Payload:   "r1",
+		req1, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
 			CreatedOn: now,
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		req2, err := insertRequest(ctx, db, Request{
-			Payload:   "r1",
+		req2, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
 			CreatedOn: now.Add(time.Second * 5),
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		req3, err := insertRequest(ctx, db, Request{
-			Payload:   "r1",
+		req3, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
 			CreatedOn: now.Add(time.Second * 10),
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		requests, err := loadUnfinishedRequests(ctx, db)
+		requests, err := store.Lease(ctx, "tests", 0, 0)
 
 		if err != nil {
 			t.Fatal(err)
-		} else if !reflect.DeepEqual([]Request{req1, req2, req3}, requests) {
+		} else if !reflect.DeepEqual(requestIds(req1, req2, req3), requestIds(requests...)) {
 			t.Errorf("gotten wrong unfinished requests slice %v", requests)
 		}
 	})
 
 	t.Run("inserting then deleting and loading unfinished requests", func(t *testing.T) {
-		db := connectToTestingDB(t)
+		store := connectToTestingStore(t)
 
 		now := time.Now()
 
-		req1, err := insertRequest(ctx, db, Request{
-			Payload:   "r1",
+		req1, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
 			CreatedOn: now,
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		req2, err := insertRequest(ctx, db, Request{
-			Payload:   "r1",
+		req2, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
 			CreatedOn: now.Add(time.Second * 5),
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		req3, err := insertRequest(ctx, db, Request{
-			Payload:   "r1",
+		req3, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
 			CreatedOn: now.Add(time.Second * 10),
 		})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		err = deleteRequestByID(ctx, db, req3.Id)
+		_, err = store.Lease(ctx, "tests", 0, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		requests, err := loadUnfinishedRequests(ctx, db)
+		err = store.Ack(ctx, "tests", req3.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err := store.Lease(ctx, "tests", 0, 0)
 
 		if err != nil {
 			t.Fatal(err)
-		} else if !reflect.DeepEqual([]Request{req1, req2}, requests) {
+		} else if !reflect.DeepEqual(requestIds(req1, req2), requestIds(requests...)) {
 			t.Errorf("gotten wrong unfinished requests slice %v", requests)
 		}
 	})
+
+	t.Run("moving a request to the dead letters", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		req, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
+			CreatedOn: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.Lease(ctx, "tests", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.DeadLetter(ctx, "other", req.Id, 500, errors.New("boom"))
+		if !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("expected a request leased by another owner to stay in the backlog but got %v", err)
+		}
+
+		err = store.DeadLetter(ctx, "tests", req.Id, 500, errors.New("boom"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err := store.Lease(ctx, "tests", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 0 {
+			t.Errorf("expected backlog to be empty but got %v", requests)
+		}
+
+		letters, err := loadDeadLetters(ctx, store)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(letters) != 1 {
+			t.Fatalf("expected 1 dead letter but got %v", letters)
+		}
+
+		letter := letters[0]
+
+		if letter.RequestId != req.Id || string(letter.Payload) != "r1" || letter.Attempts != 1 {
+			t.Errorf("dead letter does not match request %v", letter)
+		} else if letter.LastError != "boom" || letter.LastStatus != 500 {
+			t.Errorf("dead letter did not record failure %v", letter)
+		}
+	})
+
+	t.Run("loading unfinished requests skips requests that are backing off", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		now := time.Now()
+
+		req1, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
+			CreatedOn: now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req2, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r2"),
+			CreatedOn: now.Add(time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.Lease(ctx, "tests", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.Nack(ctx, "tests", req1.Id, now.Add(time.Hour), 503, errors.New("unavailable"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err := store.Lease(ctx, "tests", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 0 {
+			t.Errorf("expected requests queued after a backing off request to be held back but got %v", requests)
+		}
+
+		config.ContinueOnError = true
+		t.Cleanup(func() { config.ContinueOnError = false })
+
+		requests, err = store.Lease(ctx, "tests", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(requestIds(req2), requestIds(requests...)) {
+			t.Errorf("expected only the request that is not backing off but got %v", requests)
+		}
+
+		err = store.RetryNow(ctx, req1.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err = store.Lease(ctx, "tests", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 2 || requests[0].Attempts != 1 || requests[0].LastError != "unavailable" || requests[0].LastStatus != 503 {
+			t.Errorf("expected the failed request to be due again but got %v", requests)
+		}
+	})
+
+	t.Run("leased requests are skipped until their lease expires", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		req, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
+			CreatedOn: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err := store.Lease(ctx, "first", time.Millisecond*50, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 1 || requests[0].ClaimedBy != "first" {
+			t.Fatalf("expected the request to be leased by first but got %v", requests)
+		}
+
+		requests, err = store.Lease(ctx, "second", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 0 {
+			t.Errorf("expected a leased request not to be leased again but got %v", requests)
+		}
+
+		// first crashed without acking or nacking
+		time.Sleep(time.Millisecond * 100)
+
+		requests, err = store.Lease(ctx, "second", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 1 || requests[0].ClaimedBy != "second" {
+			t.Fatalf("expected the expired lease to be taken over by second but got %v", requests)
+		}
+
+		err = store.Ack(ctx, "first", req.Id)
+		if !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("expected first to have lost its lease but got %v", err)
+		}
+
+		err = store.Extend(ctx, "first", []int{req.Id}, time.Minute)
+		if !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("expected first not to extend a lease it lost but got %v", err)
+		}
+
+		err = store.Extend(ctx, "second", []int{req.Id}, time.Minute)
+		if err != nil {
+			t.Errorf("expected second to extend its lease but got %v", err)
+		}
+
+		_, err = store.Nack(ctx, "second", req.Id, time.Now(), 503, errors.New("unavailable"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err = store.Lease(ctx, "first", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 1 {
+			t.Errorf("expected a nacked request to be released but got %v", requests)
+		}
+	})
+
+	t.Run("leasing is limited to a batch of the oldest requests", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		now := time.Now()
+		queued := []Request{}
+
+		for i := range 5 {
+			req, err := store.Enqueue(ctx, Request{
+				Payload:   []byte("r"),
+				CreatedOn: now.Add(time.Second * time.Duration(5-i)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			queued = append(queued, req)
+		}
+
+		config.ContinueOnError = true
+		t.Cleanup(func() { config.ContinueOnError = false })
+
+		requests, err := store.Lease(ctx, "tests", time.Minute, 2)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(requestIds(queued[4], queued[3]), requestIds(requests...)) {
+			t.Errorf("expected the 2 oldest requests but got %v", requests)
+		}
+
+		requests, err = store.Lease(ctx, "tests", time.Minute, 2)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(requestIds(queued[2], queued[1]), requestIds(requests...)) {
+			t.Errorf("expected the next 2 oldest requests but got %v", requests)
+		}
+	})
+
+	t.Run("requests queued after a leased one are held back", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		now := time.Now()
+
+		_, err := store.Enqueue(ctx, Request{Payload: []byte("r1"), CreatedOn: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err := store.Lease(ctx, "first", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 1 {
+			t.Fatalf("expected the request to be leased but got %v", requests)
+		}
+
+		_, err = store.Enqueue(ctx, Request{Payload: []byte("r2"), CreatedOn: now.Add(time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests, err = store.Lease(ctx, "second", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 0 {
+			t.Errorf("expected the request queued after an in-flight one to wait but got %v", requests)
+		}
+
+		// failed requests don't hold the next ones back with the continue
+		// strategy, requests another instance is sending still do
+		config.ContinueOnError = true
+		t.Cleanup(func() { config.ContinueOnError = false })
+
+		requests, err = store.Lease(ctx, "second", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(requests) != 0 {
+			t.Errorf("expected the request queued after an in-flight one to wait with the continue strategy but got %v", requests)
+		}
+	})
+
+	t.Run("updating backlog gauges", func(t *testing.T) {
+		store := connectToTestingStore(t)
+
+		_, err := store.Enqueue(ctx, Request{
+			Payload:   []byte("r1"),
+			CreatedOn: time.Now().Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = updateBacklogGauges(ctx, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size := testutil.ToFloat64(backlogSize.WithLabelValues(config.LegacyDestinationName)); size != 1 {
+			t.Errorf("expected backlog size to be 1 but got %f", size)
+		}
+		if age := testutil.ToFloat64(backlogOldestAge.WithLabelValues(config.LegacyDestinationName)); age < 59 {
+			t.Errorf("expected oldest request age to be about 60s but got %f", age)
+		}
+	})
 }
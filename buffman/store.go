@@ -0,0 +1,233 @@
+package buffman
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mse99/buffman/config"
+	"github.com/mse99/buffman/repos"
+)
+
+// Store keeps the backlog of requests waiting to be dispatched and the dead
+// letters they end up in once they used up their attempts.
+type Store interface {
+	// Enqueue adds a request to the backlog, ErrDuplicateRequest is returned
+	// when its idempotency key was already claimed for its destination and
+	// ErrBacklogFull when the backlog has no room left for it.
+	Enqueue(ctx context.Context, req Request) (Request, error)
+	// Lease claims at most limit of the requests due for dispatch for owner,
+	// oldest first, a limit of 0 claims all of them. Other owners don't get
+	// them until leaseFor has passed, after which requests that were neither
+	// acked nor nacked are due again.
+	Lease(ctx context.Context, owner string, leaseFor time.Duration, limit int) ([]Request, error)
+	// Ack removes a delivered request from the backlog. Ack, Nack and Release
+	// return ErrLeaseLost when the request is no longer leased by owner.
+	Ack(ctx context.Context, owner string, id int) error
+	// Nack records a failed attempt, releases the lease of the request and
+	// pushes it back until nextAttemptAt, returning its updated attempt count.
+	Nack(ctx context.Context, owner string, id int, nextAttemptAt time.Time, lastStatus int, lastErr error) (int, error)
+	// Postpone records a failed attempt like Nack without counting it, for
+	// destinations that asked to be called again at nextAttemptAt.
+	Postpone(ctx context.Context, owner string, id int, nextAttemptAt time.Time, lastStatus int, lastErr error) error
+	// Extend renews the lease of requests owner still holds until leaseFor
+	// has passed, ErrLeaseLost is returned when some of them were lost.
+	Extend(ctx context.Context, owner string, ids []int, leaseFor time.Duration) error
+	// Release gives up the lease of a request without counting an attempt.
+	Release(ctx context.Context, owner string, id int) error
+	// Hold gives up the lease of a request that wasn't attempted and holds
+	// it back until nextAttemptAt, without counting an attempt.
+	Hold(ctx context.Context, owner string, id int, nextAttemptAt time.Time) error
+	// DeadLetter records a failed attempt like Nack and moves the request,
+	// along with the outcome of that attempt, from the backlog to the dead
+	// letters in the same transaction.
+	DeadLetter(ctx context.Context, owner string, id int, lastStatus int, lastErr error) error
+	// MoveToDeadLetters moves a request no one holds a lease on from the
+	// backlog to the dead letters as it is, ErrLeased is returned otherwise.
+	MoveToDeadLetters(ctx context.Context, id int) error
+
+	ListRequests(ctx context.Context, opts ListOptions) ([]Request, int, error)
+	GetRequest(ctx context.Context, id int) (Request, error)
+	// RetryNow clears the backoff of a request.
+	RetryNow(ctx context.Context, id int) error
+	DeleteRequest(ctx context.Context, id int) error
+
+	ListDeadLetters(ctx context.Context, opts ListOptions) ([]DeadLetter, int, error)
+	GetDeadLetter(ctx context.Context, id int) (DeadLetter, error)
+	// Requeue moves a dead letter back into the backlog with a fresh attempt
+	// count, keeping its original creation time.
+	Requeue(ctx context.Context, id int) (Request, error)
+	DeleteDeadLetter(ctx context.Context, id int) error
+
+	// RecordDelivery adds an attempt to the delivery log.
+	RecordDelivery(ctx context.Context, delivery Delivery) error
+	ListDeliveries(ctx context.Context, requestId int, opts ListOptions) ([]Delivery, int, error)
+	// PruneDeliveries removes the deliveries attempted before before,
+	// returning how many were removed.
+	PruneDeliveries(ctx context.Context, before time.Time) (int, error)
+
+	// CreateApiKey stores a key under its hash, ErrApiKeyExists is returned
+	// when its name is taken.
+	CreateApiKey(ctx context.Context, key ApiKey, keyHash string) (ApiKey, error)
+	// FindApiKey returns the key with the given hash unless it was revoked.
+	FindApiKey(ctx context.Context, keyHash string) (ApiKey, error)
+	ListApiKeys(ctx context.Context) ([]ApiKey, error)
+	RevokeApiKey(ctx context.Context, id int) error
+
+	// BacklogStats reports the size and oldest request of every destination
+	// that has requests waiting.
+	BacklogStats(ctx context.Context) ([]BacklogStat, error)
+	// BacklogUsage returns the number of requests in the backlog and the
+	// bytes their stored payloads take.
+	BacklogUsage(ctx context.Context) (int, int64, error)
+	// AdoptUnassigned assigns the requests and dead letters queued before
+	// destinations existed to the given destination.
+	AdoptUnassigned(ctx context.Context, destination string) error
+	// Reencrypt moves every stored payload to config.ActiveEncryptionKey.
+	Reencrypt(ctx context.Context) error
+}
+
+// BacklogStat sums up the backlog of a destination.
+type BacklogStat struct {
+	Destination string
+	Size        int
+	OldestAge   time.Duration
+}
+
+// NewStore returns the store of the given database driver.
+func NewStore(driver string, db *sql.DB) (Store, error) {
+	switch driver {
+	case config.DriverSQLite:
+		return NewSQLiteStore(db), nil
+	case config.DriverPostgres:
+		return NewPostgresStore(db), nil
+	}
+
+	return nil, fmt.Errorf("unknown database driver %s", driver)
+}
+
+func NewSQLiteStore(db *sql.DB) Store {
+	return &sqlStore{db: db, dialect: sqliteDialect}
+}
+
+func NewPostgresStore(db *sql.DB) Store {
+	return &sqlStore{db: db, dialect: postgresDialect}
+}
+
+// sqlStore implements Store for both drivers, the few statements they can't
+// share are picked from its dialect.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+type dialect struct {
+	driver string
+
+	// listFilter matches the ListOptions args.
+	listFilter string
+	// limit caps the rows selected to @limit, a negative @limit selects
+	// every row.
+	limit string
+	// lockLease runs at the start of the lease transaction so instances
+	// lease one at a time. The ordering check of a lease can't see the
+	// uncommitted leases of another instance, it would otherwise lease
+	// requests queued after the ones that instance is leasing and send them
+	// out of order.
+	lockLease string
+	// lockQuota runs at the start of Enqueue while the backlog has a limit,
+	// so the usage it is checked against can't change under it.
+	lockQuota string
+	// lockRow is appended to selects of a single request that go on to
+	// change it.
+	lockRow string
+	// lockDue is appended to the lease subquery so leasing skips the rows
+	// other instances are acking or nacking rather than waiting for them.
+	lockDue string
+	// failedOn is the @failedOn parameter, typed for INSERT ... SELECT.
+	failedOn string
+	// expireIdempotencyKeys forgets the keys claimed up to @expiredBefore.
+	expireIdempotencyKeys string
+	// pruneDeliveries removes the deliveries attempted before @before.
+	pruneDeliveries string
+	// backlogStats selects the destination, size and age in seconds of the
+	// oldest request of every destination with requests waiting, the sizes
+	// are read from the usage counters rather than counted.
+	backlogStats string
+}
+
+// julianday is used so timestamps stored with different offsets still compare
+// correctly.
+var sqliteDialect = dialect{
+	driver: config.DriverSQLite,
+	listFilter: `
+		(@createdAfter IS NULL OR julianday(createdOn) >= julianday(@createdAfter))
+		AND (@createdBefore IS NULL OR julianday(createdOn) < julianday(@createdBefore))
+		AND attempts >= @minAttempts
+		AND (@destination = '' OR destination = @destination)`,
+	limit:                 `LIMIT @limit`,
+	failedOn:              `@failedOn`,
+	expireIdempotencyKeys: `DELETE FROM IdempotencyKeys WHERE julianday(createdOn) <= julianday(@expiredBefore)`,
+	pruneDeliveries:       `DELETE FROM DeliveryLog WHERE julianday(attemptedOn) < julianday(@before)`,
+	backlogStats: `SELECT tracked.destination, tracked.requests, COALESCE((julianday('now') - julianday((
+			SELECT MIN(createdOn) FROM RequestsBacklog WHERE destination = tracked.destination
+		))) * 86400, 0)
+		FROM BacklogUsage AS tracked WHERE tracked.requests > 0`,
+}
+
+// postgres can't infer the type of parameters that are only compared to NULL,
+// so they are cast explicitly.
+var postgresDialect = dialect{
+	driver: config.DriverPostgres,
+	listFilter: `
+		(@createdAfter::timestamptz IS NULL OR createdOn >= @createdAfter::timestamptz)
+		AND (@createdBefore::timestamptz IS NULL OR createdOn < @createdBefore::timestamptz)
+		AND attempts >= @minAttempts
+		AND (@destination = '' OR destination = @destination)`,
+	limit:                 `LIMIT NULLIF(@limit::bigint, -1)`,
+	lockLease:             `SELECT pg_advisory_xact_lock(hashtext('buffman.lease'))`,
+	lockQuota:             `SELECT pg_advisory_xact_lock(hashtext('buffman.quota'))`,
+	lockRow:               `FOR UPDATE`,
+	lockDue:               `FOR UPDATE SKIP LOCKED`,
+	failedOn:              `@failedOn::timestamptz`,
+	expireIdempotencyKeys: `DELETE FROM IdempotencyKeys WHERE createdOn <= @expiredBefore`,
+	pruneDeliveries:       `DELETE FROM DeliveryLog WHERE attemptedOn < @before`,
+	backlogStats: `SELECT tracked.destination, tracked.requests, COALESCE(EXTRACT(EPOCH FROM now() - (
+			SELECT MIN(createdOn) FROM RequestsBacklog WHERE destination = tracked.destination
+		))::float8, 0)
+		FROM BacklogUsage AS tracked WHERE tracked.requests > 0`,
+}
+
+func (s *sqlStore) args(named ...sql.NamedArg) []any {
+	return repos.NamedArgs(s.dialect.driver, named...)
+}
+
+func (s *sqlStore) BacklogStats(ctx context.Context) ([]BacklogStat, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.backlogStats)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []BacklogStat{}
+
+	for rows.Next() {
+		var (
+			destination sql.NullString
+			stat        BacklogStat
+			age         float64
+		)
+
+		scanErr := rows.Scan(&destination, &stat.Size, &age)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+
+		stat.Destination = destination.String
+		stat.OldestAge = time.Duration(age * float64(time.Second))
+		stats = append(stats, stat)
+	}
+
+	return stats, rows.Err()
+}
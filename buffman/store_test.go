@@ -0,0 +1,267 @@
+package buffman
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+	"github.com/mse99/buffman/repos"
+)
+
+// connectToTestingPostgres connects to the database of POSTGRES_TEST_DSN and
+// empties it, the test is skipped when it isn't set.
+func connectToTestingPostgres(t *testing.T) Store {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	db, err := repos.Connect(ctx, config.DriverPostgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	_, truncateErr := db.ExecContext(ctx, `TRUNCATE RequestsBacklog, DeadLetters, IdempotencyKeys, DeliveryLog, ApiKeys`)
+	if truncateErr != nil {
+		t.Fatal(truncateErr)
+	}
+
+	// TRUNCATE doesn't fire the triggers keeping the backlog usage
+	_, resetErr := db.ExecContext(ctx, `DELETE FROM BacklogUsage`)
+	if resetErr != nil {
+		t.Fatal(resetErr)
+	}
+
+	return NewPostgresStore(db)
+}
+
+func TestStores(t *testing.T) {
+	config.IdempotencyWindow = time.Hour
+	t.Cleanup(func() { config.IdempotencyWindow = 0 })
+
+	stores := map[string]func(t *testing.T) Store{
+		config.DriverSQLite:   func(t *testing.T) Store { return connectToTestingStore(t) },
+		config.DriverPostgres: connectToTestingPostgres,
+	}
+
+	for driver, connect := range stores {
+		t.Run(driver, func(t *testing.T) {
+			store := connect(t)
+			now := time.Now()
+
+			first, err := store.Enqueue(ctx, Request{
+				Destination:    config.LegacyDestinationName,
+				IdempotencyKey: "order-1",
+				Payload:        []byte("first"),
+				CreatedOn:      now.Add(-time.Minute),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = store.Enqueue(ctx, Request{
+				Destination:    config.LegacyDestinationName,
+				IdempotencyKey: "order-1",
+				Payload:        []byte("first again"),
+				CreatedOn:      now,
+			})
+			if !errors.Is(err, ErrDuplicateRequest) {
+				t.Errorf("expected a duplicate request error but got %v", err)
+			}
+
+			second, err := store.Enqueue(ctx, Request{
+				Destination: config.LegacyDestinationName,
+				Payload:     []byte("second"),
+				CreatedOn:   now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leased, err := store.Lease(ctx, "tests", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(leased) != 2 || leased[0].Id != first.Id || leased[1].Id != second.Id {
+				t.Fatalf("expected both requests to be leased oldest first but got %+v", leased)
+			}
+
+			attempts, err := store.Nack(ctx, "tests", first.Id, now.Add(time.Hour), 503, errors.New("unavailable"))
+			if err != nil {
+				t.Fatal(err)
+			} else if attempts != 1 {
+				t.Errorf("expected 1 attempt but got %d", attempts)
+			}
+
+			leased, err = store.Lease(ctx, "tests", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(leased) != 0 {
+				t.Errorf("expected the backing off request to hold the one after it but got %+v", leased)
+			}
+
+			requests, total, err := store.ListRequests(ctx, ListOptions{MinAttempts: 1, CreatedBefore: now})
+			if err != nil {
+				t.Fatal(err)
+			} else if total != 1 || len(requests) != 1 || requests[0].LastStatus != 503 {
+				t.Errorf("expected the failed request to be listed but got %+v", requests)
+			}
+
+			stats, err := store.BacklogStats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(stats) != 1 || stats[0].Size != 2 || stats[0].OldestAge < 59*time.Second {
+				t.Errorf("expected a backlog of 2 requests about a minute old but got %+v", stats)
+			}
+
+			size, bytes, err := store.BacklogUsage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			} else if size != 2 || bytes == 0 {
+				t.Errorf("expected 2 requests taking some bytes but got %d taking %d", size, bytes)
+			}
+
+			if err := store.MoveToDeadLetters(ctx, first.Id); err != nil {
+				t.Fatal(err)
+			}
+
+			letters, total, err := store.ListDeadLetters(ctx, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			} else if total != 1 || string(letters[0].Payload) != "first" || letters[0].LastError != "unavailable" {
+				t.Fatalf("expected the failed request in the dead letters but got %+v", letters)
+			}
+
+			requeued, err := store.Requeue(ctx, letters[0].Id)
+			if err != nil {
+				t.Fatal(err)
+			} else if requeued.Attempts != 0 || string(requeued.Payload) != "first" {
+				t.Errorf("expected the request to be requeued with fresh attempts but got %+v", requeued)
+			}
+
+			err = store.RecordDelivery(ctx, Delivery{
+				RequestId:   second.Id,
+				Destination: config.LegacyDestinationName,
+				Attempt:     1,
+				Status:      200,
+				Headers:     map[string][]string{"Content-Type": {"text/plain"}},
+				Body:        []byte("OK"),
+				AttemptedOn: now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deliveries, total, err := store.ListDeliveries(ctx, second.Id, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			} else if total != 1 || deliveries[0].Status != 200 || string(deliveries[0].Body) != "OK" || deliveries[0].Headers.Get("Content-Type") != "text/plain" {
+				t.Errorf("expected the delivery to be recorded but got %+v", deliveries)
+			}
+
+			err = store.RecordDelivery(ctx, Delivery{
+				RequestId:   second.Id,
+				Destination: config.LegacyDestinationName,
+				Attempt:     1,
+				Status:      503,
+				AttemptedOn: now.Add(-time.Hour * 48),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pruned, err := store.PruneDeliveries(ctx, now.Add(-time.Hour*24))
+			if err != nil {
+				t.Fatal(err)
+			} else if pruned != 1 {
+				t.Errorf("expected the old delivery to be pruned but %d were", pruned)
+			}
+
+			deliveries, total, err = store.ListDeliveries(ctx, second.Id, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			} else if total != 1 || deliveries[0].Status != 200 {
+				t.Errorf("expected only the recent delivery to be kept but got %+v", deliveries)
+			}
+
+			key, secret, err := NewApiKey(ctx, store, "odoo", []string{"fma"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := NewApiKey(ctx, store, "odoo", nil); !errors.Is(err, ErrApiKeyExists) {
+				t.Errorf("expected a duplicate api key error but got %v", err)
+			}
+
+			found, err := AuthenticateApiKey(ctx, store, secret)
+			if err != nil {
+				t.Fatal(err)
+			} else if found.Id != key.Id || !found.Allows("fma") || found.Allows("erp") {
+				t.Errorf("expected the api key to be scoped to fma but got %+v", found)
+			}
+
+			if err := store.RevokeApiKey(ctx, key.Id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := AuthenticateApiKey(ctx, store, secret); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected the revoked api key to be rejected but got %v", err)
+			}
+
+			if err := store.Ack(ctx, "tests", second.Id); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.GetRequest(ctx, second.Id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected the acked request to be gone but got %v", err)
+			}
+		})
+	}
+}
+
+// TestPostgresConcurrentLeases races two instances leasing a request each, the
+// earlier rounds stay leased so only the requests of the round are due.
+func TestPostgresConcurrentLeases(t *testing.T) {
+	store := connectToTestingPostgres(t)
+
+	for round := range 20 {
+		now := time.Now()
+
+		for i := range 2 {
+			_, err := store.Enqueue(ctx, Request{
+				Destination: config.LegacyDestinationName,
+				OrderingKey: fmt.Sprintf("order-%d", round),
+				Payload:     []byte("{}"),
+				CreatedOn:   now.Add(time.Duration(i) * time.Millisecond),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var (
+			wg     = sync.WaitGroup{}
+			leased = make([][]Request, 2)
+			errs   = make([]error, 2)
+		)
+		for i, owner := range []string{"first", "second"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				leased[i], errs[i] = store.Lease(ctx, owner, time.Minute, 1)
+			}()
+		}
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			t.Fatal(err)
+		} else if len(leased[0])+len(leased[1]) != 1 {
+			t.Fatalf("expected only the oldest request of the ordering key to be leased but got %v and %v", requestIds(leased[0]...), requestIds(leased[1]...))
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package buffman
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+const (
+	// tokenRefreshMargin is the most we refresh a token ahead of its expiry,
+	// short lived tokens are refreshed when 90% of their lifetime has passed.
+	tokenRefreshMargin = time.Minute
+
+	// minTokenRefreshDelay keeps upstreams that hand out already expired
+	// tokens from being hammered with logins.
+	minTokenRefreshDelay = time.Second
+
+	// tokenRetryDelay is the longest we wait before retrying a failed refresh.
+	tokenRetryDelay = time.Second * 10
+)
+
+// issuedToken is a token along with its expiry, expiresAt is zero when the
+// upstream did not tell us when the token expires.
+type issuedToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+// tokenFetcher obtains a fresh token from an upstream.
+type tokenFetcher func(ctx context.Context) (issuedToken, error)
+
+// refreshingToken keeps the last token obtained by fetch and replaces it
+// shortly before it expires, or on config.LoginInterval when the expiry is unknown.
+type refreshingToken struct {
+	sync.RWMutex
+
+	last        issuedToken
+	lastErr     error
+	ctx         context.Context
+	destination string
+	fetch       tokenFetcher
+}
+
+func (tk *refreshingToken) get() string {
+	tk.RLock()
+	defer tk.RUnlock()
+
+	return tk.last.value
+}
+
+func (tk *refreshingToken) refresh() {
+	tk.Lock()
+	defer tk.Unlock()
+
+	tk.fetchLocked()
+}
+
+// refreshIfStale replaces a token that was rejected by the upstream. Callers
+// holding the same stale token wait on the lock for a single refresh, those
+// arriving after it find the token already replaced. It reports whether a
+// token different from stale is available.
+func (tk *refreshingToken) refreshIfStale(stale string) bool {
+	tk.Lock()
+	defer tk.Unlock()
+
+	if tk.last.value != stale {
+		return true
+	}
+
+	return tk.fetchLocked() == nil
+}
+
+func (tk *refreshingToken) fetchLocked() error {
+	next, err := tk.fetch(tk.ctx)
+	observeTokenRefresh(tk.destination, err)
+
+	tk.lastErr = err
+	if err != nil {
+		log.Println("error while refreshing token", err)
+		return err
+	}
+	tk.last = next
+
+	return nil
+}
+
+// nextRefreshIn returns how long to wait before refreshing the current token.
+func (tk *refreshingToken) nextRefreshIn() time.Duration {
+	tk.RLock()
+	defer tk.RUnlock()
+
+	if tk.lastErr != nil {
+		return min(config.LoginInterval, tokenRetryDelay)
+	} else if tk.last.expiresAt.IsZero() {
+		return config.LoginInterval
+	}
+
+	lifetime := time.Until(tk.last.expiresAt)
+	delay := lifetime - min(lifetime/10, tokenRefreshMargin)
+
+	return max(delay, minTokenRefreshDelay)
+}
+
+func (tk *refreshingToken) waitAndRefresh() {
+	timer := time.NewTimer(tk.nextRefreshIn())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-tk.ctx.Done():
+			log.Println("stopping token refresh")
+			return
+
+		case <-timer.C:
+			log.Println("refreshing token")
+			tk.refresh()
+			timer.Reset(tk.nextRefreshIn())
+		}
+	}
+}
+
+func newRefreshingToken(ctx context.Context, destination string, fetch tokenFetcher) (*refreshingToken, error) {
+	last, err := fetch(ctx)
+	if err != nil {
+		return &refreshingToken{}, err
+	}
+
+	token := refreshingToken{
+		ctx:         ctx,
+		last:        last,
+		destination: destination,
+		fetch:       fetch,
+	}
+
+	return &token, nil
+}
+
+// jwtExpiry reads the exp claim of a JWT, it returns the zero time for tokens
+// that are not JWTs or don't expire.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, decodeErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if decodeErr != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(claims.Exp), 0)
+}
+
+// tokenExpiry prefers an explicit lifetime in seconds reported by the
+// upstream and falls back to the token's own JWT exp claim.
+func tokenExpiry(token string, expiresIn float64) time.Time {
+	if expiresIn > 0 {
+		return time.Now().Add(time.Duration(expiresIn * float64(time.Second)))
+	}
+
+	return jwtExpiry(token)
+}
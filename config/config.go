@@ -1,8 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -15,11 +17,70 @@ var (
 	FmaLoginURL     string
 	FmaDispatchURL  string
 	DbFile          string
+	DbDriver        string
 	Env             string
 	OdooSecret      string
+	AdminToken      string
 	PollInterval    time.Duration
 	LoginInterval   time.Duration
 	ContinueOnError bool
+	MaxAttempts     int
+	Workers         int
+	BatchSize       int
+
+	InstanceId    string
+	LeaseDuration time.Duration
+
+	UpstreamTimeout time.Duration
+
+	IdempotencyWindow time.Duration
+
+	PayloadCompression   string
+	CompressionThreshold int
+
+	DeliveryLogBodyLimit int
+	DeliveryLogRetention time.Duration
+
+	BreakerThreshold int
+	BreakerCoolDown  time.Duration
+
+	RateLimit      float64
+	RateLimitBurst int
+
+	IngestIPLimit     int
+	IngestTokenLimit  int
+	IngestLimitWindow time.Duration
+
+	MaxBacklogSize        int
+	MaxBacklogBytes       int64
+	BacklogFullPolicy     string
+	BacklogFullRetryAfter time.Duration
+
+	BackoffBase       time.Duration
+	BackoffMultiplier float64
+	BackoffJitter     float64
+	BackoffMax        time.Duration
+)
+
+// Database drivers, see DbDriver.
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// What happens to inbound requests once the backlog is full, see
+// BacklogFullPolicy.
+const (
+	BacklogFullReject429  = "reject-429"
+	BacklogFullReject503  = "reject-503"
+	BacklogFullDropOldest = "drop-oldest"
+)
+
+// Payload compression algorithms, see PayloadCompression.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
 )
 
 func loadConfigFromEnv() {
@@ -34,7 +95,26 @@ func loadConfigFromEnv() {
 	FmaLoginURL = getEnv("FMA_LOGIN_URL")
 	FmaDispatchURL = getEnv("FMA_DISPATCH_URL")
 	DbFile = getEnv("DB")
+	DbDriver = getEnv("DB_DRIVER", DriverSQLite)
+	if DbDriver != DriverSQLite && DbDriver != DriverPostgres {
+		log.Panicf("unknown database driver %s", DbDriver)
+	}
 	OdooSecret = getEnv("ODOO_SECRET")
+	AdminToken = getEnv("ADMIN_TOKEN")
+	DefaultDestination = getEnv("DEFAULT_DESTINATION")
+
+	Destinations = nil
+	if destinationsFile := getEnv("DESTINATIONS_FILE"); destinationsFile != "" {
+		destinations, destinationsErr := loadDestinationsFile(destinationsFile)
+		if destinationsErr != nil {
+			log.Panic(destinationsErr)
+		}
+		Destinations = destinations
+	}
+
+	if _, found := FindDestination(GetDefaultDestination()); !found {
+		log.Panicf("default destination %s is not configured", DefaultDestination)
+	}
 	ContinueOnError = getEnv("DISPATCH_STRATEGY", "break") == "continue"
 
 	parsedPollIntr, pollErr := time.ParseDuration(getEnv("POLL_INTERVAL", "1s"))
@@ -48,6 +128,176 @@ func loadConfigFromEnv() {
 		log.Panic(loginErr)
 	}
 	LoginInterval = loginRefreshIntr
+
+	maxAttempts, maxAttemptsErr := strconv.Atoi(getEnv("MAX_ATTEMPTS", "10"))
+	if maxAttemptsErr != nil {
+		log.Panic(maxAttemptsErr)
+	}
+	MaxAttempts = maxAttempts
+
+	workers, workersErr := strconv.Atoi(getEnv("DISPATCH_WORKERS", "1"))
+	if workersErr != nil {
+		log.Panic(workersErr)
+	}
+	Workers = workers
+
+	batchSize, batchSizeErr := strconv.Atoi(getEnv("BATCH_SIZE", "100"))
+	if batchSizeErr != nil {
+		log.Panic(batchSizeErr)
+	}
+	BatchSize = batchSize
+
+	InstanceId = getEnv("INSTANCE_ID", defaultInstanceId())
+
+	leaseDuration, leaseDurationErr := time.ParseDuration(getEnv("LEASE_DURATION", "5m"))
+	if leaseDurationErr != nil {
+		log.Panic(leaseDurationErr)
+	}
+	LeaseDuration = leaseDuration
+
+	upstreamTimeout, upstreamTimeoutErr := time.ParseDuration(getEnv("UPSTREAM_TIMEOUT", "30s"))
+	if upstreamTimeoutErr != nil {
+		log.Panic(upstreamTimeoutErr)
+	}
+	UpstreamTimeout = upstreamTimeout
+
+	idempotencyWindow, idempotencyWindowErr := time.ParseDuration(getEnv("IDEMPOTENCY_WINDOW", "24h"))
+	if idempotencyWindowErr != nil {
+		log.Panic(idempotencyWindowErr)
+	}
+	IdempotencyWindow = idempotencyWindow
+
+	PayloadCompression = getEnv("PAYLOAD_COMPRESSION", CompressionNone)
+	switch PayloadCompression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		log.Panicf("unknown payload compression %s", PayloadCompression)
+	}
+
+	compressionThreshold, compressionThresholdErr := strconv.Atoi(getEnv("COMPRESSION_THRESHOLD", "1024"))
+	if compressionThresholdErr != nil {
+		log.Panic(compressionThresholdErr)
+	}
+	CompressionThreshold = compressionThreshold
+
+	deliveryLogBodyLimit, deliveryLogBodyLimitErr := strconv.Atoi(getEnv("DELIVERY_LOG_BODY_LIMIT", "4096"))
+	if deliveryLogBodyLimitErr != nil {
+		log.Panic(deliveryLogBodyLimitErr)
+	}
+	DeliveryLogBodyLimit = deliveryLogBodyLimit
+
+	deliveryLogRetention, deliveryLogRetentionErr := time.ParseDuration(getEnv("DELIVERY_LOG_RETENTION", "168h"))
+	if deliveryLogRetentionErr != nil {
+		log.Panic(deliveryLogRetentionErr)
+	}
+	DeliveryLogRetention = deliveryLogRetention
+
+	breakerThreshold, breakerThresholdErr := strconv.Atoi(getEnv("BREAKER_THRESHOLD", "5"))
+	if breakerThresholdErr != nil {
+		log.Panic(breakerThresholdErr)
+	}
+	BreakerThreshold = breakerThreshold
+
+	breakerCoolDown, breakerCoolDownErr := time.ParseDuration(getEnv("BREAKER_COOL_DOWN", "30s"))
+	if breakerCoolDownErr != nil {
+		log.Panic(breakerCoolDownErr)
+	}
+	BreakerCoolDown = breakerCoolDown
+
+	rateLimit, rateLimitErr := strconv.ParseFloat(getEnv("RATE_LIMIT", "0"), 64)
+	if rateLimitErr != nil {
+		log.Panic(rateLimitErr)
+	}
+	RateLimit = rateLimit
+
+	rateLimitBurst, rateLimitBurstErr := strconv.Atoi(getEnv("RATE_LIMIT_BURST", "1"))
+	if rateLimitBurstErr != nil {
+		log.Panic(rateLimitBurstErr)
+	}
+	RateLimitBurst = rateLimitBurst
+
+	ingestIPLimit, ingestIPLimitErr := strconv.Atoi(getEnv("INGEST_IP_LIMIT", "0"))
+	if ingestIPLimitErr != nil {
+		log.Panic(ingestIPLimitErr)
+	}
+	IngestIPLimit = ingestIPLimit
+
+	ingestTokenLimit, ingestTokenLimitErr := strconv.Atoi(getEnv("INGEST_TOKEN_LIMIT", "0"))
+	if ingestTokenLimitErr != nil {
+		log.Panic(ingestTokenLimitErr)
+	}
+	IngestTokenLimit = ingestTokenLimit
+
+	ingestLimitWindow, ingestLimitWindowErr := time.ParseDuration(getEnv("INGEST_LIMIT_WINDOW", "1m"))
+	if ingestLimitWindowErr != nil {
+		log.Panic(ingestLimitWindowErr)
+	}
+	IngestLimitWindow = ingestLimitWindow
+
+	maxBacklogSize, maxBacklogSizeErr := strconv.Atoi(getEnv("MAX_BACKLOG_SIZE", "0"))
+	if maxBacklogSizeErr != nil {
+		log.Panic(maxBacklogSizeErr)
+	}
+	MaxBacklogSize = maxBacklogSize
+
+	maxBacklogBytes, maxBacklogBytesErr := strconv.ParseInt(getEnv("MAX_BACKLOG_BYTES", "0"), 10, 64)
+	if maxBacklogBytesErr != nil {
+		log.Panic(maxBacklogBytesErr)
+	}
+	MaxBacklogBytes = maxBacklogBytes
+
+	BacklogFullPolicy = getEnv("BACKLOG_FULL_POLICY", BacklogFullReject503)
+	switch BacklogFullPolicy {
+	case BacklogFullReject429, BacklogFullReject503, BacklogFullDropOldest:
+	default:
+		log.Panicf("unknown backlog full policy %s", BacklogFullPolicy)
+	}
+
+	backlogFullRetryAfter, backlogFullRetryAfterErr := time.ParseDuration(getEnv("BACKLOG_FULL_RETRY_AFTER", "1m"))
+	if backlogFullRetryAfterErr != nil {
+		log.Panic(backlogFullRetryAfterErr)
+	}
+	BacklogFullRetryAfter = backlogFullRetryAfter
+
+	encryptionErr := loadEncryptionKeys()
+	if encryptionErr != nil {
+		log.Panic(encryptionErr)
+	}
+
+	backoffBase, backoffBaseErr := time.ParseDuration(getEnv("BACKOFF_BASE", "1s"))
+	if backoffBaseErr != nil {
+		log.Panic(backoffBaseErr)
+	}
+	BackoffBase = backoffBase
+
+	backoffMultiplier, backoffMultiplierErr := strconv.ParseFloat(getEnv("BACKOFF_MULTIPLIER", "2"), 64)
+	if backoffMultiplierErr != nil {
+		log.Panic(backoffMultiplierErr)
+	}
+	BackoffMultiplier = backoffMultiplier
+
+	backoffJitter, backoffJitterErr := strconv.ParseFloat(getEnv("BACKOFF_JITTER", "0.2"), 64)
+	if backoffJitterErr != nil {
+		log.Panic(backoffJitterErr)
+	}
+	BackoffJitter = backoffJitter
+
+	backoffMax, backoffMaxErr := time.ParseDuration(getEnv("BACKOFF_MAX", "10m"))
+	if backoffMaxErr != nil {
+		log.Panic(backoffMaxErr)
+	}
+	BackoffMax = backoffMax
+}
+
+// defaultInstanceId tells apart the instances sharing a database, it only has
+// to be unique while they are running.
+func defaultInstanceId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "buffman"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
 
 func getEnv(key string, def ...string) string {
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/base64"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestGetEnv(t *testing.T) {
@@ -59,7 +62,34 @@ func TestLoadConfigFromEnv(t *testing.T) {
 		os.Setenv("FMA_DISPATCH_URL", "dispatch")
 		os.Setenv("DB", "FILO.db")
 		os.Setenv("ODOO_SECRET", "FOO")
+		os.Setenv("ADMIN_TOKEN", "BAR")
 		os.Setenv("DISPATCH_STRATEGY", "continue")
+		os.Setenv("MAX_ATTEMPTS", "5")
+		os.Setenv("DISPATCH_WORKERS", "4")
+		os.Setenv("BATCH_SIZE", "250")
+		os.Setenv("INSTANCE_ID", "buffman-1")
+		os.Setenv("LEASE_DURATION", "30s")
+		os.Setenv("UPSTREAM_TIMEOUT", "10s")
+		os.Setenv("IDEMPOTENCY_WINDOW", "1h")
+		os.Setenv("PAYLOAD_COMPRESSION", "zstd")
+		os.Setenv("COMPRESSION_THRESHOLD", "512")
+		os.Setenv("DELIVERY_LOG_BODY_LIMIT", "128")
+		os.Setenv("DELIVERY_LOG_RETENTION", "24h")
+		os.Setenv("BREAKER_THRESHOLD", "3")
+		os.Setenv("BREAKER_COOL_DOWN", "1m")
+		os.Setenv("RATE_LIMIT", "2.5")
+		os.Setenv("RATE_LIMIT_BURST", "10")
+		os.Setenv("INGEST_IP_LIMIT", "100")
+		os.Setenv("INGEST_TOKEN_LIMIT", "1000")
+		os.Setenv("INGEST_LIMIT_WINDOW", "10s")
+		os.Setenv("MAX_BACKLOG_SIZE", "50000")
+		os.Setenv("MAX_BACKLOG_BYTES", "1073741824")
+		os.Setenv("BACKLOG_FULL_POLICY", "drop-oldest")
+		os.Setenv("BACKLOG_FULL_RETRY_AFTER", "30s")
+		os.Setenv("BACKOFF_BASE", "2s")
+		os.Setenv("BACKOFF_MULTIPLIER", "3")
+		os.Setenv("BACKOFF_JITTER", "0.5")
+		os.Setenv("BACKOFF_MAX", "1h")
 
 		loadConfigFromEnv()
 
@@ -91,8 +121,260 @@ func TestLoadConfigFromEnv(t *testing.T) {
 			t.Errorf("expected odooSecret to be FOO but got, %s", OdooSecret)
 		}
 
+		if AdminToken != "BAR" {
+			t.Errorf("expected adminToken to be BAR but got, %s", AdminToken)
+		}
+
 		if !ContinueOnError {
 			t.Errorf("expected ContinueOnError to be true")
 		}
+
+		if MaxAttempts != 5 {
+			t.Errorf("expected MaxAttempts to be 5 but got, %d", MaxAttempts)
+		}
+
+		if Workers != 4 {
+			t.Errorf("expected Workers to be 4 but got, %d", Workers)
+		}
+
+		if BatchSize != 250 {
+			t.Errorf("expected BatchSize to be 250 but got, %d", BatchSize)
+		}
+
+		if InstanceId != "buffman-1" || LeaseDuration != time.Second*30 {
+			t.Errorf("expected buffman-1 to lease for 30s but got, %s for %s", InstanceId, LeaseDuration)
+		}
+
+		if UpstreamTimeout != time.Second*10 {
+			t.Errorf("expected UpstreamTimeout to be 10s but got, %s", UpstreamTimeout)
+		}
+
+		if IdempotencyWindow != time.Hour {
+			t.Errorf("expected IdempotencyWindow to be 1h but got, %s", IdempotencyWindow)
+		}
+
+		if PayloadCompression != CompressionZstd || CompressionThreshold != 512 {
+			t.Errorf("expected zstd compression from 512 bytes but got, %s from %d", PayloadCompression, CompressionThreshold)
+		}
+
+		if DeliveryLogBodyLimit != 128 || DeliveryLogRetention != time.Hour*24 {
+			t.Errorf("expected deliveries to be logged up to 128 bytes for 24h but got, %d for %s", DeliveryLogBodyLimit, DeliveryLogRetention)
+		}
+
+		if BreakerThreshold != 3 || BreakerCoolDown != time.Minute {
+			t.Errorf("expected the breaker to open after 3 failures for 1m but got, %d for %s", BreakerThreshold, BreakerCoolDown)
+		}
+
+		if RateLimit != 2.5 || RateLimitBurst != 10 {
+			t.Errorf("expected 2.5 requests per second with bursts of 10 but got, %f with bursts of %d", RateLimit, RateLimitBurst)
+		}
+
+		if IngestIPLimit != 100 || IngestTokenLimit != 1000 || IngestLimitWindow != time.Second*10 {
+			t.Errorf("expected 100 requests per IP and 1000 per token every 10s but got, %d and %d every %s", IngestIPLimit, IngestTokenLimit, IngestLimitWindow)
+		}
+
+		if MaxBacklogSize != 50000 || MaxBacklogBytes != 1<<30 {
+			t.Errorf("expected a backlog of at most 50000 requests and 1GiB but got, %d and %d", MaxBacklogSize, MaxBacklogBytes)
+		}
+
+		if BacklogFullPolicy != BacklogFullDropOldest || BacklogFullRetryAfter != time.Second*30 {
+			t.Errorf("expected full backlogs to drop their oldest requests but got, %s retrying after %s", BacklogFullPolicy, BacklogFullRetryAfter)
+		}
+
+		if BackoffBase != time.Second*2 {
+			t.Errorf("expected BackoffBase to be 2s but got, %s", BackoffBase)
+		}
+
+		if BackoffMultiplier != 3 {
+			t.Errorf("expected BackoffMultiplier to be 3 but got, %f", BackoffMultiplier)
+		}
+
+		if BackoffJitter != 0.5 {
+			t.Errorf("expected BackoffJitter to be 0.5 but got, %f", BackoffJitter)
+		}
+
+		if BackoffMax != time.Hour {
+			t.Errorf("expected BackoffMax to be 1h but got, %s", BackoffMax)
+		}
 	})
 }
+
+func TestLoadDestinationsFile(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		os.Setenv("DESTINATION_PASSWORD", "secret")
+		t.Cleanup(func() { os.Unsetenv("DESTINATION_PASSWORD") })
+
+		filename := filepath.Join(t.TempDir(), "destinations.json")
+		writeErr := os.WriteFile(filename, []byte(`[
+			{
+				"name": "fma",
+				"url": "https://fma/dispatch",
+				"headers": { "x-app": "buffman" },
+				"auth": { "loginUrl": "https://fma/login", "username": "admin", "password": "${DESTINATION_PASSWORD}" },
+				"retry": { "maxAttempts": 3, "baseDelay": "5s" },
+				"failures": [{ "status": "409", "action": "success" }, { "status": "4xx", "body": "invalid", "action": "dead-letter" }],
+				"timeout": "10s"
+			},
+			{ "name": "erp", "url": "https://erp/webhook", "orderingKey": { "header": "X-Entity-Id", "jsonPath": "record.id" }, "batch": { "maxItems": 50, "format": "ndjson" } }
+		]`), 0o600)
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+
+		destinations, err := loadDestinationsFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(destinations) != 2 {
+			t.Fatalf("expected 2 destinations but got %d", len(destinations))
+		}
+
+		fma := destinations[0]
+
+		if fma.Auth.Password != "secret" {
+			t.Errorf("expected password to be expanded from the environment but got %s", fma.Auth.Password)
+		}
+		if fma.Headers["x-app"] != "buffman" {
+			t.Errorf("expected x-app header to be buffman but got %s", fma.Headers["x-app"])
+		}
+		if fma.Retry.MaxAttempts != 3 || fma.Retry.BaseDelay.Duration != time.Second*5 {
+			t.Errorf("unexpected retry policy %+v", fma.Retry)
+		}
+
+		if len(fma.Failures) != 2 || fma.Failures[1].Status != (StatusRange{400, 499}) || !fma.Failures[1].Body.MatchString("invalid payload") {
+			t.Errorf("unexpected failure rules %+v", fma.Failures)
+		}
+		if fma.Timeout.Duration != time.Second*10 {
+			t.Errorf("expected a 10s timeout but got %s", fma.Timeout)
+		}
+
+		erp := destinations[1]
+
+		if erp.OrderingKey.Header != "X-Entity-Id" || erp.OrderingKey.JSONPath != "record.id" {
+			t.Errorf("unexpected ordering key %+v", erp.OrderingKey)
+		}
+		if !erp.Batch.Enabled() || erp.Batch.GetFormat() != BatchNDJSON || fma.Batch.Enabled() {
+			t.Errorf("expected only erp to batch as ndjson but got %+v and %+v", erp.Batch, fma.Batch)
+		}
+	})
+
+	t.Run("UnknownBatchFormat", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "destinations.json")
+		writeErr := os.WriteFile(filename, []byte(`[
+			{ "name": "fma", "url": "https://fma/one", "batch": { "maxItems": 10, "format": "xml" } }
+		]`), 0o600)
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+
+		_, err := loadDestinationsFile(filename)
+		if err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+
+	t.Run("InvalidFailureRules", func(t *testing.T) {
+		for _, rules := range []string{
+			`[{ "status": "6xx", "action": "retry" }]`,
+			`[{ "status": "500-400", "action": "retry" }]`,
+			`[{ "status": "500", "action": "ignore" }]`,
+			`[{ "error": "timeout", "status": "504", "action": "retry" }]`,
+			`[{ "body": "(", "action": "retry" }]`,
+			`[{ "action": "success" }]`,
+		} {
+			filename := filepath.Join(t.TempDir(), "destinations.json")
+			writeErr := os.WriteFile(filename, []byte(`[{ "name": "fma", "url": "https://fma/one", "failures": `+rules+` }]`), 0o600)
+			if writeErr != nil {
+				t.Fatal(writeErr)
+			}
+
+			_, err := loadDestinationsFile(filename)
+			if err == nil {
+				t.Errorf("expected %s to be rejected", rules)
+			}
+		}
+	})
+
+	t.Run("DuplicateName", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "destinations.json")
+		writeErr := os.WriteFile(filename, []byte(`[
+			{ "name": "fma", "url": "https://fma/one" },
+			{ "name": "fma", "url": "https://fma/two" }
+		]`), 0o600)
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+
+		_, err := loadDestinationsFile(filename)
+		if err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	valid := []AuthConfig{
+		{},
+		{LoginURL: "https://fma/login"},
+		{Type: AuthBearer, Token: "t"},
+		{Type: AuthBasic, Username: "admin"},
+		{Type: AuthOAuth2, TokenURL: "https://idp/token", ClientID: "buffman"},
+		{Type: AuthApiKey, Header: "X-Api-Key", Key: "k"},
+	}
+	for _, auth := range valid {
+		if err := auth.validate(); err != nil {
+			t.Errorf("expected %+v to be valid but got %v", auth, err)
+		}
+	}
+
+	invalid := []AuthConfig{
+		{Type: "kerberos"},
+		{Type: AuthFmaLogin},
+		{Type: AuthBearer},
+		{Type: AuthOAuth2, TokenURL: "https://idp/token"},
+		{Type: AuthApiKey, Header: "X-Api-Key"},
+	}
+	for _, auth := range invalid {
+		if err := auth.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", auth)
+		}
+	}
+}
+
+func TestRetryPolicyResolve(t *testing.T) {
+	MaxAttempts = 10
+	BackoffBase = time.Second
+	t.Cleanup(func() {
+		MaxAttempts = 0
+		BackoffBase = 0
+	})
+
+	resolved := RetryPolicy{MaxAttempts: 3}.Resolve()
+
+	if resolved.MaxAttempts != 3 {
+		t.Errorf("expected MaxAttempts to be kept at 3 but got %d", resolved.MaxAttempts)
+	}
+	if resolved.BaseDelay.Duration != time.Second {
+		t.Errorf("expected BaseDelay to fall back to 1s but got %s", resolved.BaseDelay)
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	keys, active, err := parseEncryptionKeys("# rotated in 2025\n2025:" + key + "\n2024:" + key)
+	if err != nil {
+		t.Fatal(err)
+	} else if active != "2025" || len(keys) != 2 {
+		t.Errorf("expected 2 keys with 2025 active but got %d with %s active", len(keys), active)
+	}
+
+	_, _, err = parseEncryptionKeys("short:" + base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	if err == nil {
+		t.Error("expected keys that aren't 32 bytes long to be rejected")
+	}
+
+	_, _, err = parseEncryptionKeys("k1:" + key + ",k1:" + key)
+	if err == nil {
+		t.Error("expected duplicate key ids to be rejected")
+	}
+}
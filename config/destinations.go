@@ -0,0 +1,519 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LegacyDestinationName is the name given to the destination built from the
+// FMA_* variables when no DESTINATIONS_FILE is configured.
+const LegacyDestinationName = "fma"
+
+var (
+	// Destinations holds the upstreams loaded from DESTINATIONS_FILE, use
+	// GetDestinations to also account for the FMA_* fallback.
+	Destinations []Destination
+
+	// DefaultDestination receives the requests that don't name one, it falls
+	// back to the first destination when empty.
+	DefaultDestination string
+)
+
+// Duration is a time.Duration that reads "5s" style strings from JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var raw string
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	parsed, parseErr := time.ParseDuration(raw)
+	if parseErr != nil {
+		return parseErr
+	}
+	d.Duration = parsed
+
+	return nil
+}
+
+type Destination struct {
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers"`
+	Auth        AuthConfig        `json:"auth"`
+	Retry       RetryPolicy       `json:"retry"`
+	OrderingKey OrderingKeyConfig `json:"orderingKey"`
+
+	// IdempotencyKeyPath is a dot separated path to the idempotency key in JSON
+	// payloads, used when the request has no Idempotency-Key header.
+	IdempotencyKeyPath string `json:"idempotencyKeyPath"`
+
+	// ForwardHeaders lists the inbound request headers that are stored with
+	// the request and replayed upstream.
+	ForwardHeaders []string `json:"forwardHeaders"`
+
+	Batch BatchConfig `json:"batch"`
+
+	// Failures decide what becomes of a failed attempt, the first matching
+	// rule wins. Without a match 2xx responses succeed and the rest is retried.
+	Failures []FailureRule `json:"failures"`
+
+	// Timeout bounds every call to the destination, response body included.
+	Timeout Duration `json:"timeout"`
+
+	Breaker   BreakerConfig   `json:"breaker"`
+	RateLimit RateLimitConfig `json:"rateLimit"`
+}
+
+// OrderingKeyConfig tells where to find the key of requests that have to be
+// delivered in order, a request header or a dot separated path in a JSON payload.
+type OrderingKeyConfig struct {
+	Header   string `json:"header"`
+	JSONPath string `json:"jsonPath"`
+}
+
+const (
+	BatchJSON   = "json"
+	BatchNDJSON = "ndjson"
+)
+
+// BatchConfig groups the payloads of up to MaxItems requests, and MaxBytes
+// when set, into a single upstream call. Batching is off unless MaxItems is
+// above 1.
+type BatchConfig struct {
+	MaxItems int    `json:"maxItems"`
+	MaxBytes int    `json:"maxBytes"`
+	Format   string `json:"format"`
+
+	// ResultsPath is a dot separated path to an array in the upstream
+	// response holding the result of every item, in the order they were
+	// sent. Without it a batch succeeds or fails as a whole.
+	ResultsPath string `json:"resultsPath"`
+	// ItemStatusPath and ItemErrorPath are read from each result, an item
+	// succeeded when its status is a 2xx code or true.
+	ItemStatusPath string `json:"itemStatusPath"`
+	ItemErrorPath  string `json:"itemErrorPath"`
+}
+
+func (b BatchConfig) Enabled() bool {
+	return b.MaxItems > 1
+}
+
+func (b BatchConfig) GetFormat() string {
+	if b.Format == "" {
+		return BatchJSON
+	}
+
+	return b.Format
+}
+
+func (b BatchConfig) GetItemStatusPath() string {
+	if b.ItemStatusPath == "" {
+		return "status"
+	}
+
+	return b.ItemStatusPath
+}
+
+func (b BatchConfig) GetItemErrorPath() string {
+	if b.ItemErrorPath == "" {
+		return "error"
+	}
+
+	return b.ItemErrorPath
+}
+
+func (b BatchConfig) validate() error {
+	switch b.GetFormat() {
+	case BatchJSON, BatchNDJSON:
+	default:
+		return fmt.Errorf("unknown batch format %s", b.Format)
+	}
+
+	return nil
+}
+
+const (
+	FailureRetry      = "retry"
+	FailureDeadLetter = "dead-letter"
+	FailureSuccess    = "success"
+
+	FailureNetwork = "network"
+	FailureTimeout = "timeout"
+)
+
+// FailureRule gives the action to take on the attempts it matches, a rule
+// matches when all of its set conditions do.
+type FailureRule struct {
+	// Status is a code like "409", a class like "4xx" or a range like
+	// "500-504".
+	Status StatusRange `json:"status"`
+	// Error matches attempts that got no response, "network" for any
+	// transport error and "timeout" for timeouts only.
+	Error string `json:"error"`
+	// Body is a regular expression searched in the response body.
+	Body   Pattern `json:"body"`
+	Action string  `json:"action"`
+}
+
+func (r FailureRule) validate() error {
+	switch r.Action {
+	case FailureRetry, FailureDeadLetter, FailureSuccess:
+	default:
+		return fmt.Errorf("unknown failure action %q", r.Action)
+	}
+
+	switch r.Error {
+	case "":
+		if r.Status.IsZero() && r.Body.Regexp == nil {
+			return errors.New("failure rules need a status, an error or a body")
+		}
+	case FailureNetwork, FailureTimeout:
+		if !r.Status.IsZero() || r.Body.Regexp != nil {
+			return errors.New("failure rules on errors can't match a status or a body")
+		}
+	default:
+		return fmt.Errorf("unknown failure error %q", r.Error)
+	}
+
+	return nil
+}
+
+// StatusRange is an inclusive range of status codes read from "409", "4xx"
+// or "500-504".
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+func (r StatusRange) IsZero() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+func (r StatusRange) Contains(status int) bool {
+	return status >= r.Min && status <= r.Max
+}
+
+func (r *StatusRange) UnmarshalJSON(data []byte) error {
+	var raw string
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	parsed, parseErr := parseStatusRange(raw)
+	if parseErr != nil {
+		return parseErr
+	}
+	*r = parsed
+
+	return nil
+}
+
+func parseStatusRange(raw string) (StatusRange, error) {
+	invalidErr := fmt.Errorf("invalid status range %q", raw)
+
+	if class, found := strings.CutSuffix(strings.ToLower(raw), "xx"); found {
+		digit, err := strconv.Atoi(class)
+		if err != nil || digit < 1 || digit > 5 {
+			return StatusRange{}, invalidErr
+		}
+
+		return StatusRange{Min: digit * 100, Max: digit*100 + 99}, nil
+	}
+
+	from, to, isRange := strings.Cut(raw, "-")
+	if !isRange {
+		to = from
+	}
+
+	low, lowErr := strconv.Atoi(strings.TrimSpace(from))
+	high, highErr := strconv.Atoi(strings.TrimSpace(to))
+	if lowErr != nil || highErr != nil || low < 100 || high > 599 || low > high {
+		return StatusRange{}, invalidErr
+	}
+
+	return StatusRange{Min: low, Max: high}, nil
+}
+
+// Pattern is a regular expression compiled when read from JSON.
+type Pattern struct {
+	*regexp.Regexp
+}
+
+func (p *Pattern) UnmarshalJSON(data []byte) error {
+	var raw string
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	compiled, compileErr := regexp.Compile(raw)
+	if compileErr != nil {
+		return compileErr
+	}
+	p.Regexp = compiled
+
+	return nil
+}
+
+const (
+	AuthNone     = "none"
+	AuthFmaLogin = "fma-login"
+	AuthBearer   = "bearer"
+	AuthBasic    = "basic"
+	AuthOAuth2   = "oauth2"
+	AuthApiKey   = "api-key"
+)
+
+// AuthConfig describes how requests to a destination are authenticated, only
+// the fields of the selected Type are used.
+type AuthConfig struct {
+	Type string `json:"type"`
+
+	// fma-login, and basic for the credentials
+	LoginURL     string            `json:"loginUrl"`
+	Username     string            `json:"username"`
+	Password     string            `json:"password"`
+	LoginHeaders map[string]string `json:"loginHeaders"`
+	TokenPath    string            `json:"tokenPath"`
+
+	// bearer
+	Token string `json:"token"`
+
+	// oauth2 client credentials
+	TokenURL     string   `json:"tokenUrl"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+
+	// api-key
+	Header string `json:"header"`
+	Key    string `json:"key"`
+}
+
+// GetType returns the configured auth type, destinations that only set a
+// loginUrl keep using the FMA login flow.
+func (a AuthConfig) GetType() string {
+	if a.Type != "" {
+		return a.Type
+	} else if a.LoginURL != "" {
+		return AuthFmaLogin
+	}
+
+	return AuthNone
+}
+
+func (a AuthConfig) GetLoginHeaders() map[string]string {
+	if a.LoginHeaders == nil {
+		return map[string]string{"x-app": "operator-dashboard"}
+	}
+
+	return a.LoginHeaders
+}
+
+func (a AuthConfig) GetTokenPath() string {
+	if a.TokenPath == "" {
+		return "result.token"
+	}
+
+	return a.TokenPath
+}
+
+func (a AuthConfig) validate() error {
+	switch a.GetType() {
+	case AuthNone:
+	case AuthFmaLogin:
+		if a.LoginURL == "" {
+			return errors.New("fma-login auth needs a loginUrl")
+		}
+	case AuthBearer:
+		if a.Token == "" {
+			return errors.New("bearer auth needs a token")
+		}
+	case AuthBasic:
+		if a.Username == "" {
+			return errors.New("basic auth needs a username")
+		}
+	case AuthOAuth2:
+		if a.TokenURL == "" || a.ClientID == "" {
+			return errors.New("oauth2 auth needs a tokenUrl and a clientId")
+		}
+	case AuthApiKey:
+		if a.Header == "" || a.Key == "" {
+			return errors.New("api-key auth needs a header and a key")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %s", a.Type)
+	}
+
+	return nil
+}
+
+// BreakerConfig stops calls to a destination for CoolDown once FailureThreshold
+// attempts in a row failed, zero values fall back to the BREAKER_* variables
+// and a negative threshold turns the breaker off.
+type BreakerConfig struct {
+	FailureThreshold int      `json:"failureThreshold"`
+	CoolDown         Duration `json:"coolDown"`
+}
+
+// Resolve fills in the unset fields of the breaker from the global defaults.
+func (b BreakerConfig) Resolve() BreakerConfig {
+	if b.FailureThreshold == 0 {
+		b.FailureThreshold = BreakerThreshold
+	}
+	if b.CoolDown.Duration == 0 {
+		b.CoolDown.Duration = BreakerCoolDown
+	}
+
+	return b
+}
+
+// RateLimitConfig caps the calls made to a destination to RequestsPerSecond,
+// with bursts of up to Burst calls. Zero values fall back to the RATE_LIMIT
+// variables and a negative rate turns the limit off.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+// Resolve fills in the unset fields of the limit from the global defaults.
+func (r RateLimitConfig) Resolve() RateLimitConfig {
+	if r.RequestsPerSecond == 0 {
+		r.RequestsPerSecond = RateLimit
+	}
+	if r.Burst == 0 {
+		r.Burst = max(RateLimitBurst, 1)
+	}
+
+	return r
+}
+
+// RetryPolicy controls how failed requests are retried, zero values fall back
+// to the MAX_ATTEMPTS and BACKOFF_* variables.
+type RetryPolicy struct {
+	MaxAttempts int      `json:"maxAttempts"`
+	BaseDelay   Duration `json:"baseDelay"`
+	Multiplier  float64  `json:"multiplier"`
+	Jitter      float64  `json:"jitter"`
+	MaxDelay    Duration `json:"maxDelay"`
+}
+
+// Resolve fills in the unset fields of the policy from the global defaults.
+func (p RetryPolicy) Resolve() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = MaxAttempts
+	}
+	if p.BaseDelay.Duration == 0 {
+		p.BaseDelay.Duration = BackoffBase
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = BackoffMultiplier
+	}
+	if p.Jitter == 0 {
+		p.Jitter = BackoffJitter
+	}
+	if p.MaxDelay.Duration == 0 {
+		p.MaxDelay.Duration = BackoffMax
+	}
+
+	return p
+}
+
+func loadDestinationsFile(filename string) ([]Destination, error) {
+	raw, readErr := os.ReadFile(filename)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var destinations []Destination
+
+	// secrets can be kept out of the file and referenced as ${VAR}
+	decodeErr := json.Unmarshal([]byte(os.ExpandEnv(string(raw))), &destinations)
+	if decodeErr != nil {
+		return nil, fmt.Errorf("error while reading destinations file: %w", decodeErr)
+	}
+
+	seen := map[string]bool{}
+
+	for _, dest := range destinations {
+		if dest.Name == "" || dest.URL == "" {
+			return nil, fmt.Errorf("destinations need both a name and a url: %+v", dest)
+		} else if seen[dest.Name] {
+			return nil, fmt.Errorf("destination %s is defined more than once", dest.Name)
+		}
+
+		authErr := dest.Auth.validate()
+		if authErr != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, authErr)
+		}
+
+		batchErr := dest.Batch.validate()
+		if batchErr != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, batchErr)
+		}
+
+		for _, rule := range dest.Failures {
+			ruleErr := rule.validate()
+			if ruleErr != nil {
+				return nil, fmt.Errorf("destination %s: %w", dest.Name, ruleErr)
+			}
+		}
+		seen[dest.Name] = true
+	}
+
+	return destinations, nil
+}
+
+// GetDestinations returns the configured destinations, or a single one built
+// from the FMA_* variables when no destinations file was loaded.
+func GetDestinations() []Destination {
+	if len(Destinations) > 0 {
+		return Destinations
+	}
+
+	return []Destination{
+		{
+			Name: LegacyDestinationName,
+			URL:  FmaDispatchURL,
+			Auth: AuthConfig{
+				Type:     AuthFmaLogin,
+				LoginURL: FmaLoginURL,
+				Username: FmaUsername,
+				Password: FmaPassword,
+			},
+		},
+	}
+}
+
+func FindDestination(name string) (Destination, bool) {
+	for _, dest := range GetDestinations() {
+		if dest.Name == name {
+			return dest, true
+		}
+	}
+
+	return Destination{}, false
+}
+
+func GetDefaultDestination() string {
+	if DefaultDestination != "" {
+		return DefaultDestination
+	}
+
+	return GetDestinations()[0].Name
+}
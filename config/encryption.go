@@ -0,0 +1,79 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// EncryptionKeys are the AES-256 keys payloads can be encrypted with,
+	// indexed by their id.
+	EncryptionKeys map[string][]byte
+
+	// ActiveEncryptionKey is the id of the key new payloads are encrypted
+	// with, payloads stay in plaintext when it is empty.
+	ActiveEncryptionKey string
+)
+
+// loadEncryptionKeys reads the ENCRYPTION_KEYS variable, or the file named by
+// ENCRYPTION_KEYS_FILE, the first key listed is the active one.
+func loadEncryptionKeys() error {
+	EncryptionKeys = nil
+	ActiveEncryptionKey = ""
+
+	entries := getEnv("ENCRYPTION_KEYS")
+	if keysFile := getEnv("ENCRYPTION_KEYS_FILE"); keysFile != "" {
+		raw, readErr := os.ReadFile(keysFile)
+		if readErr != nil {
+			return readErr
+		}
+		entries = string(raw)
+	}
+
+	keys, active, err := parseEncryptionKeys(entries)
+	if err != nil {
+		return err
+	}
+
+	EncryptionKeys = keys
+	ActiveEncryptionKey = active
+
+	return nil
+}
+
+// parseEncryptionKeys parses "id:base64-key" entries separated by commas or
+// new lines, lines starting with # are ignored.
+func parseEncryptionKeys(entries string) (map[string][]byte, string, error) {
+	keys := map[string][]byte{}
+	active := ""
+
+	for _, entry := range strings.FieldsFunc(entries, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" {
+			return nil, "", fmt.Errorf("encryption keys must be written as id:base64-key")
+		} else if _, duplicate := keys[id]; duplicate {
+			return nil, "", fmt.Errorf("encryption key %s is defined more than once", id)
+		}
+
+		key, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			return nil, "", fmt.Errorf("encryption key %s: %w", id, decodeErr)
+		} else if len(key) != 32 {
+			return nil, "", fmt.Errorf("encryption key %s must be 32 bytes long but is %d", id, len(key))
+		}
+
+		keys[id] = key
+		if active == "" {
+			active = id
+		}
+	}
+
+	return keys, active, nil
+}
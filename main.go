@@ -22,18 +22,31 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
 
-	db, dbErr := repos.ConnectToDB(ctx, config.DbFile)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateErr := runMigrateCommand(ctx, os.Stdout, os.Args[2:])
+		if migrateErr != nil {
+			log.Fatal(migrateErr)
+		}
+		return
+	}
+
+	db, dbErr := repos.Connect(ctx, config.DbDriver, config.DbFile)
 	if dbErr != nil {
 		log.Fatal(dbErr)
 	}
 	defer db.Close()
 
-	dispatchErr := buffman.StartDispatchToFMA(ctx, db)
+	store, storeErr := buffman.NewStore(config.DbDriver, db)
+	if storeErr != nil {
+		log.Fatal(storeErr)
+	}
+
+	dispatchErr := buffman.StartDispatch(ctx, store)
 	if dispatchErr != nil {
 		log.Panic(dispatchErr)
 	}
 
-	app := web.CreateServer(ctx, db)
+	app := web.CreateServer(ctx, store)
 
 	go func() {
 		err := app.Listen(":" + config.HttpPort)
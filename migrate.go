@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/mse99/buffman/config"
+	"github.com/mse99/buffman/repos"
+)
+
+const migrateUsage = `usage: buffman migrate <command> [flags]
+
+commands:
+  up [-dry-run]  apply the pending migrations, or only list them with -dry-run
+  status         list the applied and pending migrations`
+
+// runMigrateCommand handles `buffman migrate`, it works on the database
+// configured with DB and DB_DRIVER without starting the server.
+func runMigrateCommand(ctx context.Context, out io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, dbErr := repos.OpenDB(config.DbDriver, config.DbFile)
+	if dbErr != nil {
+		return dbErr
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		flags := flag.NewFlagSet("migrate up", flag.ContinueOnError)
+		flags.SetOutput(out)
+		dryRun := flags.Bool("dry-run", false, "only list the migrations that would be applied")
+
+		if parseErr := flags.Parse(args[1:]); parseErr != nil {
+			return parseErr
+		}
+
+		migrations, err := repos.Migrate(ctx, db, config.DbDriver, *dryRun)
+		if err != nil {
+			return err
+		}
+
+		verb := "applied"
+		if *dryRun {
+			verb = "would apply"
+		}
+
+		if len(migrations) == 0 {
+			fmt.Fprintln(out, "database is up to date")
+		}
+		for _, migration := range migrations {
+			fmt.Fprintf(out, "%s %04d_%s\n", verb, migration.Version, migration.Name)
+		}
+
+		return nil
+	case "status":
+		applied, err := repos.AppliedMigrations(ctx, db, config.DbDriver)
+		if err != nil {
+			return err
+		}
+
+		pending, pendingErr := repos.PendingMigrations(ctx, db, config.DbDriver)
+		if pendingErr != nil {
+			return pendingErr
+		}
+
+		for _, migration := range applied {
+			fmt.Fprintf(out, "applied %04d_%s on %s\n", migration.Version, migration.Name, migration.AppliedOn.Format("2006-01-02 15:04:05"))
+		}
+		for _, migration := range pending {
+			fmt.Fprintf(out, "pending %04d_%s\n", migration.Version, migration.Name)
+		}
+
+		return nil
+	}
+
+	return errors.New(migrateUsage)
+}
@@ -3,26 +3,170 @@ package repos
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/mse99/buffman/config"
 )
 
+// addedColumns are the columns that were introduced before migrations were
+// versioned, databases created without them get upgraded before the first
+// migration is recorded.
+var addedColumns = []struct {
+	table      string
+	name       string
+	definition string
+}{
+	{"RequestsBacklog", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"RequestsBacklog", "nextAttemptAt", "DATETIME"},
+	{"RequestsBacklog", "lastError", "TEXT"},
+	{"RequestsBacklog", "lastStatus", "INTEGER"},
+	{"RequestsBacklog", "destination", "TEXT"},
+	{"DeadLetters", "destination", "TEXT"},
+	{"RequestsBacklog", "orderingKey", "TEXT"},
+	{"DeadLetters", "orderingKey", "TEXT"},
+	{"RequestsBacklog", "idempotencyKey", "TEXT"},
+	{"DeadLetters", "idempotencyKey", "TEXT"},
+	{"RequestsBacklog", "method", "TEXT"},
+	{"RequestsBacklog", "headers", "TEXT"},
+	{"RequestsBacklog", "query", "TEXT"},
+	{"RequestsBacklog", "contentType", "TEXT"},
+	{"DeadLetters", "method", "TEXT"},
+	{"DeadLetters", "headers", "TEXT"},
+	{"DeadLetters", "query", "TEXT"},
+	{"DeadLetters", "contentType", "TEXT"},
+	{"RequestsBacklog", "contentEncoding", "TEXT"},
+	{"DeadLetters", "contentEncoding", "TEXT"},
+	{"RequestsBacklog", "compression", "TEXT"},
+	{"DeadLetters", "compression", "TEXT"},
+	{"RequestsBacklog", "keyId", "TEXT"},
+	{"RequestsBacklog", "wrappedKey", "BLOB"},
+	{"DeadLetters", "keyId", "TEXT"},
+	{"DeadLetters", "wrappedKey", "BLOB"},
+}
+
+// ConnectToDB opens a SQLite database and applies the pending migrations.
 func ConnectToDB(ctx context.Context, dbFilename string) (*sql.DB, error) {
-	conn, err := sql.Open("sqlite3", dbFilename)
+	return Connect(ctx, config.DriverSQLite, dbFilename)
+}
+
+// Connect opens the database of the given driver and applies the pending
+// migrations.
+func Connect(ctx context.Context, driver, dsn string) (*sql.DB, error) {
+	conn, err := OpenDB(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	_, execErr := conn.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS RequestsBacklog (
-			id INTEGER PRIMARY KEY,
-			payload TEXT,
-			createdOn DATETIME
-		);
-	`)
-	if execErr != nil {
-		return nil, execErr
+	_, migrateErr := Migrate(ctx, conn, driver, false)
+	if migrateErr != nil {
+		conn.Close()
+		return nil, migrateErr
 	}
 
 	return conn, nil
 }
+
+// OpenDB opens the database as is, without applying migrations.
+func OpenDB(driver, dsn string) (*sql.DB, error) {
+	switch driver {
+	case config.DriverSQLite:
+		conn, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		// sqlite only allows a single writer, and every new connection to
+		// ":memory:" opens a brand new empty database, so we stick to one.
+		conn.SetMaxOpenConns(1)
+
+		return conn, nil
+	case config.DriverPostgres:
+		return sql.Open("pgx", dsn)
+	}
+
+	return nil, fmt.Errorf("unknown database driver %s", driver)
+}
+
+// NamedArgs adapts sql.Named arguments to the driver, pgx expects them to be
+// bundled in a single pgx.NamedArgs.
+func NamedArgs(driver string, named ...sql.NamedArg) []any {
+	if driver == config.DriverPostgres {
+		args := pgx.NamedArgs{}
+		for _, arg := range named {
+			args[arg.Name] = arg.Value
+		}
+
+		return []any{args}
+	}
+
+	args := make([]any, len(named))
+	for i, arg := range named {
+		args[i] = arg
+	}
+
+	return args
+}
+
+// upgradeLegacySchema brings tables created before migrations were versioned
+// up to the shape of the first migration.
+func upgradeLegacySchema(ctx context.Context, conn *sql.DB) error {
+	for _, col := range addedColumns {
+		exists, existsErr := tableExists(ctx, conn, config.DriverSQLite, col.table)
+		if existsErr != nil {
+			return existsErr
+		} else if !exists {
+			continue
+		}
+
+		columnErr := ensureColumn(ctx, conn, col.table, col.name, col.definition)
+		if columnErr != nil {
+			return columnErr
+		}
+	}
+
+	return nil
+}
+
+func tableExists(ctx context.Context, conn *sql.DB, driver, table string) (bool, error) {
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = @table`
+	if driver == config.DriverPostgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = lower(@table)`
+	}
+
+	var count int
+	err := conn.QueryRowContext(ctx, query, NamedArgs(driver, sql.Named("table", table))...).Scan(&count)
+
+	return count > 0, err
+}
+
+// ensureColumn adds a column to tables created by older versions of buffman.
+func ensureColumn(ctx context.Context, conn *sql.DB, table, column, definition string) error {
+	rows, err := conn.QueryContext(ctx, `SELECT name FROM pragma_table_info(@table)`, sql.Named("table", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+
+		scanErr := rows.Scan(&name)
+		if scanErr != nil {
+			return scanErr
+		}
+
+		if name == column {
+			return nil
+		}
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return rowsErr
+	}
+	rows.Close()
+
+	_, alterErr := conn.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return alterErr
+}
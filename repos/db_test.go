@@ -2,7 +2,11 @@ package repos
 
 import (
 	"context"
+	"database/sql"
+	"path/filepath"
 	"testing"
+
+	"github.com/mse99/buffman/config"
 )
 
 var ctx = context.Background()
@@ -23,3 +27,37 @@ func Test_ConnectToDB(t *testing.T) {
 		t.Error(closeErr)
 	}
 }
+
+func Test_ConnectToDBUpgradesOldSchema(t *testing.T) {
+	t.Parallel()
+
+	dbFile := filepath.Join(t.TempDir(), "old.db")
+
+	old, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.ExecContext(ctx, `CREATE TABLE RequestsBacklog (id INTEGER PRIMARY KEY, payload TEXT, createdOn DATETIME)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db, err := ConnectToDB(ctx, dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, `UPDATE RequestsBacklog SET attempts = attempts + 1, nextAttemptAt = NULL, lastError = NULL, lastStatus = NULL`)
+	if err != nil {
+		t.Errorf("new columns were not added %v", err)
+	}
+
+	pending, pendingErr := PendingMigrations(ctx, db, config.DriverSQLite)
+	if pendingErr != nil {
+		t.Fatal(pendingErr)
+	} else if len(pending) != 0 {
+		t.Errorf("expected the upgraded database to be fully migrated but %+v are pending", pending)
+	}
+}
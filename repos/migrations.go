@@ -0,0 +1,257 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// schemaVersionTables records the applied migrations of each driver.
+var schemaVersionTables = map[string]string{
+	config.DriverSQLite: `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			appliedOn DATETIME NOT NULL
+		)`,
+	config.DriverPostgres: `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			appliedOn TIMESTAMPTZ NOT NULL
+		)`,
+}
+
+// Migration is a schema change shipped with buffman, migrations are applied
+// in the order of their version and each one only once.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// AppliedMigration is a migration recorded in the schema_version table.
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedOn time.Time
+}
+
+// Migrations lists the embedded migrations of a driver, read from files
+// named migrations/<driver>/<version>_<name>.sql.
+func Migrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", migrationsDir(driver))
+
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	seen := map[int]bool{}
+
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+
+		rawVersion, name, found := strings.Cut(base, "_")
+		version, versionErr := strconv.Atoi(rawVersion)
+		if !found || versionErr != nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", entry.Name())
+		} else if seen[version] {
+			return nil, fmt.Errorf("migration version %d is used more than once", version)
+		}
+		seen[version] = true
+
+		content, readErr := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func migrationsDir(driver string) string {
+	if driver == config.DriverPostgres {
+		return "postgres"
+	}
+
+	return "sqlite"
+}
+
+// AppliedMigrations lists the migrations recorded in the database, it is
+// empty for databases that were never migrated.
+func AppliedMigrations(ctx context.Context, conn *sql.DB, driver string) ([]AppliedMigration, error) {
+	versioned, err := tableExists(ctx, conn, driver, "schema_version")
+	if err != nil || !versioned {
+		return nil, err
+	}
+
+	rows, queryErr := conn.QueryContext(ctx, `SELECT version, name, appliedOn FROM schema_version ORDER BY version ASC`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	applied := []AppliedMigration{}
+
+	for rows.Next() {
+		var migration AppliedMigration
+
+		scanErr := rows.Scan(&migration.Version, &migration.Name, &migration.AppliedOn)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, rows.Err()
+}
+
+// PendingMigrations lists the embedded migrations that were not applied yet.
+func PendingMigrations(ctx context.Context, conn *sql.DB, driver string) ([]Migration, error) {
+	migrations, err := Migrations(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, appliedErr := AppliedMigrations(ctx, conn, driver)
+	if appliedErr != nil {
+		return nil, appliedErr
+	}
+
+	done := map[int]bool{}
+	for _, migration := range applied {
+		done[migration.Version] = true
+	}
+
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if !done[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, each in its own
+// transaction, and returns them. With dryRun the pending migrations are only
+// returned.
+func Migrate(ctx context.Context, conn *sql.DB, driver string, dryRun bool) ([]Migration, error) {
+	if dryRun {
+		return PendingMigrations(ctx, conn, driver)
+	}
+
+	unlock, lockErr := lockMigrations(ctx, conn, driver)
+	if lockErr != nil {
+		return nil, fmt.Errorf("error while locking migrations: %w", lockErr)
+	}
+	defer unlock()
+
+	pending, err := PendingMigrations(ctx, conn, driver)
+	if err != nil || len(pending) == 0 {
+		return pending, err
+	}
+
+	versioned, versionedErr := tableExists(ctx, conn, driver, "schema_version")
+	if versionedErr != nil {
+		return nil, versionedErr
+	}
+
+	if !versioned {
+		// only SQLite databases predate versioned migrations
+		if driver == config.DriverSQLite {
+			legacyErr := upgradeLegacySchema(ctx, conn)
+			if legacyErr != nil {
+				return nil, fmt.Errorf("error while upgrading legacy schema: %w", legacyErr)
+			}
+		}
+
+		_, createErr := conn.ExecContext(ctx, schemaVersionTables[driver])
+		if createErr != nil {
+			return nil, createErr
+		}
+	}
+
+	for _, migration := range pending {
+		applyErr := applyMigration(ctx, conn, driver, migration)
+		if applyErr != nil {
+			return nil, fmt.Errorf("error while applying migration %d_%s: %w", migration.Version, migration.Name, applyErr)
+		}
+	}
+
+	return pending, nil
+}
+
+// lockMigrations keeps other instances from migrating a Postgres database until
+// the returned function is called, instances starting together would apply
+// the same migrations otherwise. SQLite only lets a single writer in already.
+func lockMigrations(ctx context.Context, conn *sql.DB, driver string) (func(), error) {
+	if driver != config.DriverPostgres {
+		return func() {}, nil
+	}
+
+	// advisory locks belong to the session that took them, so the same
+	// connection has to release it
+	lockConn, connErr := conn.Conn(ctx)
+	if connErr != nil {
+		return nil, connErr
+	}
+
+	_, lockErr := lockConn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext('buffman.migrate'))`)
+	if lockErr != nil {
+		lockConn.Close()
+		return nil, lockErr
+	}
+
+	return func() {
+		lockConn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext('buffman.migrate'))`)
+		lockConn.Close()
+	}, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.DB, driver string, migration Migration) error {
+	tx, txErr := conn.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	_, execErr := tx.ExecContext(ctx, migration.SQL)
+	if execErr != nil {
+		return execErr
+	}
+
+	_, recordErr := tx.ExecContext(
+		ctx,
+		`INSERT INTO schema_version (version, name, appliedOn) VALUES (@version, @name, @appliedOn)`,
+		NamedArgs(
+			driver,
+			sql.Named("version", migration.Version),
+			sql.Named("name", migration.Name),
+			sql.Named("appliedOn", time.Now()),
+		)...,
+	)
+	if recordErr != nil {
+		return recordErr
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS RequestsBacklog (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	payload BYTEA,
+	createdOn TIMESTAMPTZ,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	nextAttemptAt TIMESTAMPTZ,
+	lastError TEXT,
+	lastStatus INTEGER,
+	destination TEXT,
+	orderingKey TEXT,
+	idempotencyKey TEXT,
+	method TEXT,
+	headers TEXT,
+	query TEXT,
+	contentType TEXT,
+	contentEncoding TEXT,
+	compression TEXT,
+	keyId TEXT,
+	wrappedKey BYTEA
+);
+
+CREATE TABLE IF NOT EXISTS DeadLetters (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	requestId BIGINT,
+	destination TEXT,
+	orderingKey TEXT,
+	idempotencyKey TEXT,
+	method TEXT,
+	headers TEXT,
+	query TEXT,
+	contentType TEXT,
+	contentEncoding TEXT,
+	compression TEXT,
+	keyId TEXT,
+	wrappedKey BYTEA,
+	payload BYTEA,
+	createdOn TIMESTAMPTZ,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	lastError TEXT,
+	lastStatus INTEGER,
+	failedOn TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS IdempotencyKeys (
+	destination TEXT NOT NULL,
+	key TEXT NOT NULL,
+	requestId BIGINT,
+	createdOn TIMESTAMPTZ,
+	PRIMARY KEY (destination, key)
+);
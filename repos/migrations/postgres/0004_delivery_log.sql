@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS DeliveryLog (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	requestId BIGINT NOT NULL,
+	destination TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status INTEGER NOT NULL,
+	error TEXT,
+	responseHeaders TEXT,
+	responseBody BYTEA,
+	truncated BOOLEAN NOT NULL DEFAULT FALSE,
+	durationMs BIGINT NOT NULL,
+	attemptedOn TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS DeliveryLog_requestId ON DeliveryLog (requestId);
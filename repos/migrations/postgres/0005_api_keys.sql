@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS ApiKeys (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	keyHash TEXT NOT NULL UNIQUE,
+	destinations TEXT,
+	createdOn TIMESTAMPTZ NOT NULL,
+	revokedOn TIMESTAMPTZ
+);
+
+ALTER TABLE RequestsBacklog ADD COLUMN apiKey TEXT;
+ALTER TABLE DeadLetters ADD COLUMN apiKey TEXT;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS BacklogUsage (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	requests BIGINT NOT NULL,
+	bytes BIGINT NOT NULL
+);
+
+INSERT INTO BacklogUsage (id, requests, bytes)
+SELECT 1, COUNT(*), COALESCE(SUM(LENGTH(payload)), 0) FROM RequestsBacklog;
+
+CREATE OR REPLACE FUNCTION track_backlog_usage() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		UPDATE BacklogUsage SET requests = requests + 1, bytes = bytes + COALESCE(LENGTH(NEW.payload), 0);
+	ELSIF TG_OP = 'DELETE' THEN
+		UPDATE BacklogUsage SET requests = requests - 1, bytes = bytes - COALESCE(LENGTH(OLD.payload), 0);
+	ELSE
+		UPDATE BacklogUsage SET bytes = bytes + COALESCE(LENGTH(NEW.payload), 0) - COALESCE(LENGTH(OLD.payload), 0);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER RequestsBacklog_usage
+AFTER INSERT OR DELETE OR UPDATE OF payload ON RequestsBacklog
+FOR EACH ROW EXECUTE FUNCTION track_backlog_usage();
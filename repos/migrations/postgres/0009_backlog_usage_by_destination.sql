@@ -0,0 +1,34 @@
+DROP TRIGGER IF EXISTS RequestsBacklog_usage ON RequestsBacklog;
+DROP TABLE IF EXISTS BacklogUsage;
+
+CREATE TABLE BacklogUsage (
+	destination TEXT PRIMARY KEY,
+	requests BIGINT NOT NULL,
+	bytes BIGINT NOT NULL
+);
+
+INSERT INTO BacklogUsage (destination, requests, bytes)
+SELECT COALESCE(destination, ''), COUNT(*), COALESCE(SUM(LENGTH(payload)), 0) FROM RequestsBacklog
+GROUP BY COALESCE(destination, '');
+
+CREATE INDEX IF NOT EXISTS RequestsBacklog_destination ON RequestsBacklog (destination, createdOn);
+
+CREATE OR REPLACE FUNCTION track_backlog_usage() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP IN ('DELETE', 'UPDATE') THEN
+		UPDATE BacklogUsage SET requests = requests - 1, bytes = bytes - COALESCE(LENGTH(OLD.payload), 0)
+		WHERE destination = COALESCE(OLD.destination, '');
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		INSERT INTO BacklogUsage (destination, requests, bytes)
+		VALUES (COALESCE(NEW.destination, ''), 1, COALESCE(LENGTH(NEW.payload), 0))
+		ON CONFLICT (destination) DO UPDATE
+		SET requests = BacklogUsage.requests + EXCLUDED.requests, bytes = BacklogUsage.bytes + EXCLUDED.bytes;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER RequestsBacklog_usage
+AFTER INSERT OR DELETE OR UPDATE OF destination, payload ON RequestsBacklog
+FOR EACH ROW EXECUTE FUNCTION track_backlog_usage();
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS RequestsBacklog (
+	id INTEGER PRIMARY KEY,
+	payload BLOB,
+	createdOn DATETIME,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	nextAttemptAt DATETIME,
+	lastError TEXT,
+	lastStatus INTEGER,
+	destination TEXT,
+	orderingKey TEXT,
+	idempotencyKey TEXT,
+	method TEXT,
+	headers TEXT,
+	query TEXT,
+	contentType TEXT,
+	contentEncoding TEXT,
+	compression TEXT,
+	keyId TEXT,
+	wrappedKey BLOB
+);
+
+CREATE TABLE IF NOT EXISTS DeadLetters (
+	id INTEGER PRIMARY KEY,
+	requestId INTEGER,
+	destination TEXT,
+	orderingKey TEXT,
+	idempotencyKey TEXT,
+	method TEXT,
+	headers TEXT,
+	query TEXT,
+	contentType TEXT,
+	contentEncoding TEXT,
+	compression TEXT,
+	keyId TEXT,
+	wrappedKey BLOB,
+	payload BLOB,
+	createdOn DATETIME,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	lastError TEXT,
+	lastStatus INTEGER,
+	failedOn DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS IdempotencyKeys (
+	destination TEXT NOT NULL,
+	key TEXT NOT NULL,
+	requestId INTEGER,
+	createdOn DATETIME,
+	PRIMARY KEY (destination, key)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE RequestsBacklog ADD COLUMN claimedBy TEXT;
+ALTER TABLE RequestsBacklog ADD COLUMN leaseUntil DATETIME;
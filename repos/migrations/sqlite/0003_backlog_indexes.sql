@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS RequestsBacklog_createdOn ON RequestsBacklog (createdOn);
+CREATE INDEX IF NOT EXISTS RequestsBacklog_orderingKey ON RequestsBacklog (destination, orderingKey, createdOn);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS DeliveryLog (
+	id INTEGER PRIMARY KEY,
+	requestId INTEGER NOT NULL,
+	destination TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status INTEGER NOT NULL,
+	error TEXT,
+	responseHeaders TEXT,
+	responseBody BLOB,
+	truncated BOOLEAN NOT NULL DEFAULT FALSE,
+	durationMs INTEGER NOT NULL,
+	attemptedOn DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS DeliveryLog_requestId ON DeliveryLog (requestId);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS ApiKeys (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	keyHash TEXT NOT NULL UNIQUE,
+	destinations TEXT,
+	createdOn DATETIME NOT NULL,
+	revokedOn DATETIME
+);
+
+ALTER TABLE RequestsBacklog ADD COLUMN apiKey TEXT;
+ALTER TABLE DeadLetters ADD COLUMN apiKey TEXT;
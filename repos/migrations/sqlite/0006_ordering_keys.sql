@@ -0,0 +1,2 @@
+UPDATE RequestsBacklog SET orderingKey = '' WHERE orderingKey IS NULL;
+UPDATE DeadLetters SET orderingKey = '' WHERE orderingKey IS NULL;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS DeliveryLog_attemptedOn ON DeliveryLog (julianday(attemptedOn));
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS BacklogUsage (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	requests INTEGER NOT NULL,
+	bytes INTEGER NOT NULL
+);
+
+INSERT INTO BacklogUsage (id, requests, bytes)
+SELECT 1, COUNT(*), COALESCE(SUM(LENGTH(payload)), 0) FROM RequestsBacklog;
+
+CREATE TRIGGER IF NOT EXISTS RequestsBacklog_usage_insert AFTER INSERT ON RequestsBacklog
+BEGIN
+	UPDATE BacklogUsage SET requests = requests + 1, bytes = bytes + COALESCE(LENGTH(NEW.payload), 0);
+END;
+
+CREATE TRIGGER IF NOT EXISTS RequestsBacklog_usage_delete AFTER DELETE ON RequestsBacklog
+BEGIN
+	UPDATE BacklogUsage SET requests = requests - 1, bytes = bytes - COALESCE(LENGTH(OLD.payload), 0);
+END;
+
+CREATE TRIGGER IF NOT EXISTS RequestsBacklog_usage_update AFTER UPDATE OF payload ON RequestsBacklog
+BEGIN
+	UPDATE BacklogUsage SET bytes = bytes + COALESCE(LENGTH(NEW.payload), 0) - COALESCE(LENGTH(OLD.payload), 0);
+END;
@@ -0,0 +1,39 @@
+DROP TRIGGER IF EXISTS RequestsBacklog_usage_insert;
+DROP TRIGGER IF EXISTS RequestsBacklog_usage_delete;
+DROP TRIGGER IF EXISTS RequestsBacklog_usage_update;
+DROP TABLE IF EXISTS BacklogUsage;
+
+CREATE TABLE BacklogUsage (
+	destination TEXT PRIMARY KEY,
+	requests INTEGER NOT NULL,
+	bytes INTEGER NOT NULL
+);
+
+INSERT INTO BacklogUsage (destination, requests, bytes)
+SELECT COALESCE(destination, ''), COUNT(*), COALESCE(SUM(LENGTH(payload)), 0) FROM RequestsBacklog
+GROUP BY COALESCE(destination, '');
+
+CREATE INDEX IF NOT EXISTS RequestsBacklog_destination ON RequestsBacklog (destination, createdOn);
+
+CREATE TRIGGER RequestsBacklog_usage_insert AFTER INSERT ON RequestsBacklog
+BEGIN
+	INSERT INTO BacklogUsage (destination, requests, bytes)
+	VALUES (COALESCE(NEW.destination, ''), 1, COALESCE(LENGTH(NEW.payload), 0))
+	ON CONFLICT (destination) DO UPDATE SET requests = requests + excluded.requests, bytes = bytes + excluded.bytes;
+END;
+
+CREATE TRIGGER RequestsBacklog_usage_delete AFTER DELETE ON RequestsBacklog
+BEGIN
+	UPDATE BacklogUsage SET requests = requests - 1, bytes = bytes - COALESCE(LENGTH(OLD.payload), 0)
+	WHERE destination = COALESCE(OLD.destination, '');
+END;
+
+CREATE TRIGGER RequestsBacklog_usage_update AFTER UPDATE OF destination, payload ON RequestsBacklog
+BEGIN
+	UPDATE BacklogUsage SET requests = requests - 1, bytes = bytes - COALESCE(LENGTH(OLD.payload), 0)
+	WHERE destination = COALESCE(OLD.destination, '');
+
+	INSERT INTO BacklogUsage (destination, requests, bytes)
+	VALUES (COALESCE(NEW.destination, ''), 1, COALESCE(LENGTH(NEW.payload), 0))
+	ON CONFLICT (destination) DO UPDATE SET requests = requests + excluded.requests, bytes = bytes + excluded.bytes;
+END;
@@ -0,0 +1,143 @@
+package repos
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mse99/buffman/config"
+)
+
+func Test_Migrate(t *testing.T) {
+	t.Parallel()
+
+	migrations, err := Migrations(config.DriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(migrations) == 0 || migrations[0].Version != 1 {
+		t.Fatalf("expected the embedded migrations to start at version 1 but got %+v", migrations)
+	}
+
+	t.Run("dry run leaves the database untouched", func(t *testing.T) {
+		db, err := OpenDB(config.DriverSQLite, ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		pending, migrateErr := Migrate(ctx, db, config.DriverSQLite, true)
+		if migrateErr != nil {
+			t.Fatal(migrateErr)
+		} else if len(pending) != len(migrations) {
+			t.Errorf("expected %d pending migrations but got %d", len(migrations), len(pending))
+		}
+
+		exists, existsErr := tableExists(ctx, db, config.DriverSQLite, "RequestsBacklog")
+		if existsErr != nil {
+			t.Fatal(existsErr)
+		} else if exists {
+			t.Error("expected the dry run not to create any table")
+		}
+	})
+
+	t.Run("migrations are only applied once", func(t *testing.T) {
+		db, err := OpenDB(config.DriverSQLite, ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		applied, migrateErr := Migrate(ctx, db, config.DriverSQLite, false)
+		if migrateErr != nil {
+			t.Fatal(migrateErr)
+		} else if len(applied) != len(migrations) {
+			t.Errorf("expected %d applied migrations but got %d", len(migrations), len(applied))
+		}
+
+		again, againErr := Migrate(ctx, db, config.DriverSQLite, false)
+		if againErr != nil {
+			t.Fatal(againErr)
+		} else if len(again) != 0 {
+			t.Errorf("expected nothing left to apply but got %+v", again)
+		}
+
+		recorded, recordedErr := AppliedMigrations(ctx, db, config.DriverSQLite)
+		if recordedErr != nil {
+			t.Fatal(recordedErr)
+		} else if len(recorded) != len(migrations) {
+			t.Errorf("expected %d recorded migrations but got %d", len(migrations), len(recorded))
+		}
+	})
+
+	t.Run("postgres instances starting together migrate once", func(t *testing.T) {
+		dsn := os.Getenv("POSTGRES_TEST_DSN")
+		if dsn == "" {
+			t.Skip("POSTGRES_TEST_DSN is not set")
+		}
+
+		admin, err := OpenDB(config.DriverPostgres, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Close()
+
+		// a schema of its own gives the test a fresh database
+		schema := fmt.Sprintf("buffman_migrate_%d", time.Now().UnixNano())
+		_, err = admin.ExecContext(ctx, `CREATE SCHEMA `+schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			admin.ExecContext(ctx, `DROP SCHEMA `+schema+` CASCADE`)
+		})
+
+		separator := " "
+		if strings.Contains(dsn, "://") {
+			separator = "?"
+			if strings.Contains(dsn, "?") {
+				separator = "&"
+			}
+		}
+		schemaDSN := dsn + separator + "search_path=" + schema
+
+		pgMigrations, err := Migrations(config.DriverPostgres)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg := sync.WaitGroup{}
+		applied := make([]int, 2)
+		errs := make([]error, 2)
+
+		for i := range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				db, openErr := OpenDB(config.DriverPostgres, schemaDSN)
+				if openErr != nil {
+					errs[i] = openErr
+					return
+				}
+				defer db.Close()
+
+				migrated, migrateErr := Migrate(ctx, db, config.DriverPostgres, false)
+				applied[i], errs[i] = len(migrated), migrateErr
+			}()
+		}
+		wg.Wait()
+
+		for _, migrateErr := range errs {
+			if migrateErr != nil {
+				t.Fatal(migrateErr)
+			}
+		}
+
+		if applied[0]+applied[1] != len(pgMigrations) {
+			t.Errorf("expected the %d migrations to be applied once but got %v", len(pgMigrations), applied)
+		}
+	})
+}
@@ -0,0 +1,369 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mse99/buffman/buffman"
+	"github.com/mse99/buffman/config"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type page[T any] struct {
+	Items  []T `json:"items"`
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+func setupAdminRouter(ctx context.Context, app *fiber.App, store buffman.Store) {
+	admin := app.Group("/admin", requireAdminToken)
+
+	admin.Get("/requests", createListRequestsHandler(ctx, store))
+	admin.Get("/requests/:id", createGetRequestHandler(ctx, store))
+	admin.Post("/requests/:id/retry", createRetryRequestHandler(ctx, store))
+	admin.Delete("/requests/:id", createDeleteRequestHandler(ctx, store))
+	admin.Post("/requests/:id/dead-letter", createDeadLetterRequestHandler(ctx, store))
+	admin.Get("/requests/:id/deliveries", createListDeliveriesHandler(ctx, store))
+
+	admin.Get("/deliveries", createListDeliveriesHandler(ctx, store))
+
+	admin.Get("/dead-letters", createListDeadLettersHandler(ctx, store))
+	admin.Get("/dead-letters/:id", createGetDeadLetterHandler(ctx, store))
+	admin.Post("/dead-letters/:id/requeue", createRequeueDeadLetterHandler(ctx, store))
+	admin.Delete("/dead-letters/:id", createDeleteDeadLetterHandler(ctx, store))
+
+	admin.Get("/api-keys", createListApiKeysHandler(ctx, store))
+	admin.Post("/api-keys", createCreateApiKeyHandler(ctx, store))
+	admin.Delete("/api-keys/:id", createRevokeApiKeyHandler(ctx, store))
+}
+
+// requireAdminToken only lets through requests bearing config.AdminToken, the
+// admin API stays closed when no token is configured.
+func requireAdminToken(c *fiber.Ctx) error {
+	token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	hashedToken := sha256.Sum256([]byte(token))
+	hashedAdminToken := sha256.Sum256([]byte(config.AdminToken))
+
+	if config.AdminToken == "" || !found || subtle.ConstantTimeCompare(hashedToken[:], hashedAdminToken[:]) == 0 {
+		log.Println("received admin request with invalid token")
+		return c.Status(http.StatusUnauthorized).Send([]byte("Unauthorized"))
+	}
+
+	return c.Next()
+}
+
+func parseListOptions(c *fiber.Ctx) (buffman.ListOptions, error) {
+	opts := buffman.ListOptions{
+		Limit:       c.QueryInt("limit", defaultPageSize),
+		Offset:      c.QueryInt("offset", 0),
+		MinAttempts: c.QueryInt("minAttempts", 0),
+		Destination: c.Query("destination"),
+	}
+
+	if opts.Limit <= 0 || opts.Limit > maxPageSize {
+		return opts, errors.New("limit must be between 1 and 500")
+	} else if opts.Offset < 0 {
+		return opts, errors.New("offset cannot be negative")
+	}
+
+	for key, dest := range map[string]*time.Time{
+		"createdAfter":  &opts.CreatedAfter,
+		"createdBefore": &opts.CreatedBefore,
+	} {
+		val := c.Query(key)
+		if val == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return opts, errors.New(key + " must be an RFC3339 timestamp")
+		}
+		*dest = parsed
+	}
+
+	return opts, nil
+}
+
+// respondWithStoreError maps errors coming out of the buffman admin functions
+// to a response.
+func respondWithStoreError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, buffman.ErrNotFound) {
+		return c.Status(http.StatusNotFound).Send([]byte("Not found"))
+	}
+	if errors.Is(err, buffman.ErrLeased) {
+		return c.Status(http.StatusConflict).Send([]byte("Request is being dispatched"))
+	}
+
+	log.Println("error while handling admin request", err)
+	return c.Status(http.StatusInternalServerError).Send([]byte(""))
+}
+
+func createListRequestsHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		opts, optsErr := parseListOptions(c)
+		if optsErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte(optsErr.Error()))
+		}
+
+		requests, total, err := store.ListRequests(ctx, opts)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(page[buffman.Request]{
+			Items:  requests,
+			Total:  total,
+			Limit:  opts.Limit,
+			Offset: opts.Offset,
+		})
+	}
+}
+
+func createGetRequestHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		req, err := store.GetRequest(ctx, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(req)
+	}
+}
+
+func createRetryRequestHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		retryCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancel()
+
+		err := buffman.RetryRequestNow(retryCtx, store, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.Status(http.StatusOK).Send([]byte("OK"))
+	}
+}
+
+func createDeadLetterRequestHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		err := buffman.DeadLetterRequest(ctx, store, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.Status(http.StatusOK).Send([]byte("OK"))
+	}
+}
+
+func createDeleteRequestHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		err := store.DeleteRequest(ctx, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.Status(http.StatusOK).Send([]byte("OK"))
+	}
+}
+
+// createListDeliveriesHandler lists the delivery log, of a single request when
+// its id is given in the path or the requestId query.
+func createListDeliveriesHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		opts, optsErr := parseListOptions(c)
+		if optsErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte(optsErr.Error()))
+		}
+
+		requestId := c.QueryInt("requestId", 0)
+		if c.Params("id") != "" {
+			id, idErr := c.ParamsInt("id")
+			if idErr != nil {
+				return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+			}
+			requestId = id
+		}
+
+		deliveries, total, err := store.ListDeliveries(ctx, requestId, opts)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(page[buffman.Delivery]{
+			Items:  deliveries,
+			Total:  total,
+			Limit:  opts.Limit,
+			Offset: opts.Offset,
+		})
+	}
+}
+
+func createListDeadLettersHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		opts, optsErr := parseListOptions(c)
+		if optsErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte(optsErr.Error()))
+		}
+
+		letters, total, err := store.ListDeadLetters(ctx, opts)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(page[buffman.DeadLetter]{
+			Items:  letters,
+			Total:  total,
+			Limit:  opts.Limit,
+			Offset: opts.Offset,
+		})
+	}
+}
+
+func createGetDeadLetterHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		letter, err := store.GetDeadLetter(ctx, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(letter)
+	}
+}
+
+func createRequeueDeadLetterHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		requeueCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancel()
+
+		req, err := buffman.RequeueDeadLetter(requeueCtx, store, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(req)
+	}
+}
+
+func createDeleteDeadLetterHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		err := store.DeleteDeadLetter(ctx, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.Status(http.StatusOK).Send([]byte("OK"))
+	}
+}
+
+func createListApiKeysHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		keys, err := store.ListApiKeys(ctx)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.JSON(keys)
+	}
+}
+
+type newApiKey struct {
+	Name         string   `json:"name"`
+	Destinations []string `json:"destinations"`
+}
+
+type createdApiKey struct {
+	buffman.ApiKey
+
+	// Key is only ever returned here, it is stored hashed.
+	Key string `json:"key"`
+}
+
+func createCreateApiKeyHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var body newApiKey
+
+		parseErr := c.BodyParser(&body)
+		if parseErr != nil || body.Name == "" {
+			return c.Status(http.StatusBadRequest).Send([]byte("A name is required"))
+		}
+
+		for _, destination := range body.Destinations {
+			if _, found := config.FindDestination(destination); !found {
+				return c.Status(http.StatusBadRequest).Send([]byte("Unknown destination " + destination))
+			}
+		}
+
+		key, secret, err := buffman.NewApiKey(ctx, store, body.Name, body.Destinations)
+		if errors.Is(err, buffman.ErrApiKeyExists) {
+			return c.Status(http.StatusConflict).Send([]byte("An api key with this name already exists"))
+		} else if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.Status(http.StatusCreated).JSON(createdApiKey{ApiKey: key, Key: secret})
+	}
+}
+
+func createRevokeApiKeyHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id, idErr := c.ParamsInt("id")
+		if idErr != nil {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid id"))
+		}
+
+		err := store.RevokeApiKey(ctx, id)
+		if err != nil {
+			return respondWithStoreError(c, err)
+		}
+
+		return c.Status(http.StatusOK).Send([]byte("OK"))
+	}
+}
@@ -0,0 +1,310 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mse99/buffman/buffman"
+	"github.com/mse99/buffman/config"
+)
+
+func seedBacklog(t *testing.T, db *sql.DB, payloads ...string) {
+	for i, payload := range payloads {
+		_, err := db.ExecContext(
+			ctx,
+			`INSERT INTO RequestsBacklog (payload, createdOn) VALUES (@payload, @createdOn)`,
+			sql.Named("payload", payload),
+			sql.Named("createdOn", time.Now().Add(time.Duration(i)*time.Second)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seedDeadLetter(t *testing.T, db *sql.DB, payload string) {
+	_, err := db.ExecContext(
+		ctx,
+		`INSERT INTO DeadLetters (requestId, payload, createdOn, attempts, lastError, lastStatus, failedOn)
+		VALUES (1, @payload, @now, 3, 'boom', 500, @now)`,
+		sql.Named("payload", payload),
+		sql.Named("now", time.Now()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func seedDelivery(t *testing.T, db *sql.DB, requestId, status int) {
+	_, err := db.ExecContext(
+		ctx,
+		`INSERT INTO DeliveryLog (requestId, destination, attempt, status, responseBody, truncated, durationMs, attemptedOn)
+		VALUES (@requestId, 'fma', 1, @status, 'ok', false, 12, @now)`,
+		sql.Named("requestId", requestId),
+		sql.Named("status", status),
+		sql.Named("now", time.Now()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func adminRequest(t *testing.T, server *fiber.App, method, path string, out any) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+
+	res, err := server.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if out != nil && res.StatusCode == http.StatusOK {
+		decodeErr := json.NewDecoder(res.Body).Decode(out)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+	}
+
+	return res.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	config.AdminToken = "AdminToken"
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		server, _ := createTestingServer(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/requests", nil)
+		req.Header.Set("Authorization", "Bearer nope")
+
+		res, err := server.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		} else if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401 but got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("ListRequests", func(t *testing.T) {
+		server, db := createTestingServer(t)
+		seedBacklog(t, db, "r1", "r2", "r3")
+
+		var body page[buffman.Request]
+		status := adminRequest(t, server, http.MethodGet, "/admin/requests?limit=2&offset=1", &body)
+
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if body.Total != 3 {
+			t.Errorf("expected total to be 3 but got %d", body.Total)
+		} else if len(body.Items) != 2 || string(body.Items[0].Payload) != "r2" || string(body.Items[1].Payload) != "r3" {
+			t.Errorf("unexpected page %v", body.Items)
+		}
+	})
+
+	t.Run("ListRequestsWithFilter", func(t *testing.T) {
+		server, db := createTestingServer(t)
+		seedBacklog(t, db, "r1", "r2", "r3")
+
+		after := time.Now().Add(time.Millisecond * 500).UTC().Format(time.RFC3339Nano)
+
+		var body page[buffman.Request]
+		status := adminRequest(t, server, http.MethodGet, "/admin/requests?createdAfter="+after, &body)
+
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if body.Total != 2 || len(body.Items) != 2 {
+			t.Errorf("expected 2 requests to match the filter but got %v", body.Items)
+		}
+
+		status = adminRequest(t, server, http.MethodGet, "/admin/requests?createdAfter=yesterday", nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400 but got %d", status)
+		}
+	})
+
+	t.Run("GetRetryAndDeleteRequest", func(t *testing.T) {
+		server, db := createTestingServer(t)
+		seedBacklog(t, db, "r1")
+
+		var req buffman.Request
+		status := adminRequest(t, server, http.MethodGet, "/admin/requests/1", &req)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if string(req.Payload) != "r1" {
+			t.Errorf("unexpected request %v", req)
+		}
+
+		status = adminRequest(t, server, http.MethodPost, "/admin/requests/1/retry", nil)
+		if status != http.StatusOK {
+			t.Errorf("expected status 200 but got %d", status)
+		}
+
+		status = adminRequest(t, server, http.MethodDelete, "/admin/requests/1", nil)
+		if status != http.StatusOK {
+			t.Errorf("expected status 200 but got %d", status)
+		}
+
+		status = adminRequest(t, server, http.MethodGet, "/admin/requests/1", nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404 but got %d", status)
+		}
+	})
+
+	t.Run("DeadLetterRequest", func(t *testing.T) {
+		server, db := createTestingServer(t)
+		seedBacklog(t, db, "r1", "r2")
+
+		status := adminRequest(t, server, http.MethodPost, "/admin/requests/1/dead-letter", nil)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		}
+
+		var letters page[buffman.DeadLetter]
+		status = adminRequest(t, server, http.MethodGet, "/admin/dead-letters", &letters)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if letters.Total != 1 || letters.Items[0].RequestId != 1 {
+			t.Errorf("expected the request to be dead lettered but got %v", letters.Items)
+		}
+
+		status = adminRequest(t, server, http.MethodPost, "/admin/requests/1/dead-letter", nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404 but got %d", status)
+		}
+
+		_, err := db.ExecContext(
+			ctx,
+			`UPDATE RequestsBacklog SET claimedBy = 'other', leaseUntil = @leaseUntil WHERE id = 2`,
+			sql.Named("leaseUntil", time.Now().Add(time.Minute)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status = adminRequest(t, server, http.MethodPost, "/admin/requests/2/dead-letter", nil)
+		if status != http.StatusConflict {
+			t.Errorf("expected a leased request not to be dead lettered but got status %d", status)
+		}
+	})
+
+	t.Run("Deliveries", func(t *testing.T) {
+		server, db := createTestingServer(t)
+		seedDelivery(t, db, 1, 500)
+		seedDelivery(t, db, 1, 200)
+		seedDelivery(t, db, 2, 200)
+
+		var all page[buffman.Delivery]
+		status := adminRequest(t, server, http.MethodGet, "/admin/deliveries", &all)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if all.Total != 3 {
+			t.Errorf("expected 3 deliveries but got %v", all.Items)
+		}
+
+		var ofRequest page[buffman.Delivery]
+		status = adminRequest(t, server, http.MethodGet, "/admin/requests/1/deliveries", &ofRequest)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if ofRequest.Total != 2 || ofRequest.Items[0].Status != 200 || string(ofRequest.Items[0].Body) != "ok" {
+			t.Errorf("expected the latest attempt of request 1 first but got %v", ofRequest.Items)
+		}
+
+		var byQuery page[buffman.Delivery]
+		adminRequest(t, server, http.MethodGet, "/admin/deliveries?requestId=2", &byQuery)
+		if byQuery.Total != 1 || byQuery.Items[0].RequestId != 2 {
+			t.Errorf("expected the deliveries of request 2 but got %v", byQuery.Items)
+		}
+	})
+
+	t.Run("ApiKeys", func(t *testing.T) {
+		server, _ := createTestingServer(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/api-keys", strings.NewReader(`{"name":"odoo","destinations":["fma"]}`))
+		req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := server.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		} else if res.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status 201 but got %d", res.StatusCode)
+		}
+
+		var created createdApiKey
+		if decodeErr := json.NewDecoder(res.Body).Decode(&created); decodeErr != nil {
+			t.Fatal(decodeErr)
+		} else if created.Name != "odoo" || !strings.HasPrefix(created.Key, "bm_") {
+			t.Errorf("unexpected api key %+v", created)
+		}
+
+		var keys []buffman.ApiKey
+		status := adminRequest(t, server, http.MethodGet, "/admin/api-keys", &keys)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if len(keys) != 1 || keys[0].Destinations[0] != "fma" || !keys[0].RevokedOn.IsZero() {
+			t.Errorf("unexpected api keys %+v", keys)
+		}
+
+		status = adminRequest(t, server, http.MethodDelete, fmt.Sprintf("/admin/api-keys/%d", created.Id), nil)
+		if status != http.StatusOK {
+			t.Errorf("expected status 200 but got %d", status)
+		}
+
+		adminRequest(t, server, http.MethodGet, "/admin/api-keys", &keys)
+		if len(keys) != 1 || keys[0].RevokedOn.IsZero() {
+			t.Errorf("expected the api key to be revoked but got %+v", keys)
+		}
+
+		status = adminRequest(t, server, http.MethodDelete, fmt.Sprintf("/admin/api-keys/%d", created.Id), nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404 but got %d", status)
+		}
+	})
+
+	t.Run("DeadLetters", func(t *testing.T) {
+		server, db := createTestingServer(t)
+		seedDeadLetter(t, db, "d1")
+		seedDeadLetter(t, db, "d2")
+
+		var body page[buffman.DeadLetter]
+		status := adminRequest(t, server, http.MethodGet, "/admin/dead-letters", &body)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if body.Total != 2 || body.Items[0].LastError != "boom" {
+			t.Errorf("unexpected dead letters %v", body.Items)
+		}
+
+		var requeued buffman.Request
+		status = adminRequest(t, server, http.MethodPost, fmt.Sprintf("/admin/dead-letters/%d/requeue", body.Items[0].Id), &requeued)
+		if status != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", status)
+		} else if string(requeued.Payload) != "d1" || requeued.Attempts != 0 {
+			t.Errorf("unexpected requeued request %v", requeued)
+		}
+
+		status = adminRequest(t, server, http.MethodDelete, fmt.Sprintf("/admin/dead-letters/%d", body.Items[1].Id), nil)
+		if status != http.StatusOK {
+			t.Errorf("expected status 200 but got %d", status)
+		}
+
+		var after page[buffman.DeadLetter]
+		adminRequest(t, server, http.MethodGet, "/admin/dead-letters", &after)
+		if after.Total != 0 {
+			t.Errorf("expected dead letters to be empty but got %v", after.Items)
+		}
+
+		var backlog page[buffman.Request]
+		adminRequest(t, server, http.MethodGet, "/admin/requests", &backlog)
+		if backlog.Total != 1 || string(backlog.Items[0].Payload) != "d1" {
+			t.Errorf("expected requeued dead letter in the backlog but got %v", backlog.Items)
+		}
+	})
+}
@@ -1,15 +1,21 @@
 package web
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/mse99/buffman/buffman"
 	"github.com/mse99/buffman/config"
 	"github.com/mse99/buffman/repos"
 )
@@ -23,7 +29,7 @@ func createTestingServer(t *testing.T) (*fiber.App, *sql.DB) {
 	}
 	t.Cleanup(func() { db.Close() })
 
-	server := CreateServer(context.Background(), db)
+	server := CreateServer(context.Background(), buffman.NewSQLiteStore(db))
 	t.Cleanup(func() { server.Shutdown() })
 
 	return server, db
@@ -43,6 +49,53 @@ func TestStatusEndpoint(t *testing.T) {
 	} else if res.StatusCode != http.StatusOK {
 		t.Errorf("expected status 200 but got %d", res.StatusCode)
 	}
+	defer res.Body.Close()
+
+	body, readErr := io.ReadAll(res.Body)
+	if readErr != nil {
+		t.Fatal(readErr)
+	} else if string(body) != "OK" {
+		t.Errorf("expected the body to be OK but got %q", body)
+	}
+
+	breakersRes, err := server.Test(httptest.NewRequest(http.MethodGet, "/status/breakers", nil))
+	if err != nil {
+		t.Fatal(err)
+	} else if breakersRes.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 but got %d", breakersRes.StatusCode)
+	}
+	defer breakersRes.Body.Close()
+
+	var breakers []buffman.BreakerState
+	decodeErr := json.NewDecoder(breakersRes.Body).Decode(&breakers)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	} else if breakers == nil {
+		t.Error("expected the breakers to be listed")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	t.Parallel()
+
+	server, _ := createTestingServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	res, err := server.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", res.StatusCode)
+	}
+	defer res.Body.Close()
+
+	body, readErr := io.ReadAll(res.Body)
+	if readErr != nil {
+		t.Fatal(readErr)
+	} else if !strings.Contains(string(body), "buffman_requests_queued_total") {
+		t.Errorf("expected buffman metrics to be exposed but got %s", body)
+	}
 }
 
 func TestHandleQueueRequest(t *testing.T) {
@@ -90,4 +143,238 @@ func TestHandleQueueRequest(t *testing.T) {
 			t.Errorf("expected status 200 but got %d", res.StatusCode)
 		}
 	})
+
+	t.Run("NamedDestination", func(t *testing.T) {
+		server, _ := createTestingServer(t)
+
+		path := fmt.Sprintf("/queue/%s?token=%s", config.LegacyDestinationName, config.OdooSecret)
+
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("HelloWorld"))
+		res, resErr := server.Test(req)
+
+		if resErr != nil {
+			t.Error(resErr)
+		} else if res.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200 but got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("UnknownDestination", func(t *testing.T) {
+		server, _ := createTestingServer(t)
+
+		path := fmt.Sprintf("/queue/nowhere?token=%s", config.OdooSecret)
+
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("HelloWorld"))
+		res, resErr := server.Test(req)
+
+		if resErr != nil {
+			t.Error(resErr)
+		} else if res.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status 404 but got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("DuplicateIdempotencyKey", func(t *testing.T) {
+		config.IdempotencyWindow = time.Hour
+		t.Cleanup(func() { config.IdempotencyWindow = 0 })
+
+		server, db := createTestingServer(t)
+
+		path := fmt.Sprintf("/?token=%s", config.OdooSecret)
+
+		for i, replayed := range []string{"", "true"} {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("HelloWorld"))
+			req.Header.Set("Idempotency-Key", "order-1")
+
+			res, resErr := server.Test(req)
+			if resErr != nil {
+				t.Fatal(resErr)
+			} else if res.StatusCode != http.StatusOK {
+				t.Errorf("expected status 200 for request %d but got %d", i, res.StatusCode)
+			} else if res.Header.Get("Idempotent-Replayed") != replayed {
+				t.Errorf("expected Idempotent-Replayed to be %q for request %d but got %q", replayed, i, res.Header.Get("Idempotent-Replayed"))
+			}
+		}
+
+		var count int
+		countErr := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM RequestsBacklog`).Scan(&count)
+		if countErr != nil {
+			t.Fatal(countErr)
+		} else if count != 1 {
+			t.Errorf("expected the duplicate to be dropped but found %d queued requests", count)
+		}
+	})
+
+	t.Run("PreservesMethodQueryAndContentType", func(t *testing.T) {
+		server, db := createTestingServer(t)
+
+		path := fmt.Sprintf("/queue/%s?token=%s&id=7", config.LegacyDestinationName, config.OdooSecret)
+
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.Header.Set("Content-Type", "text/plain")
+
+		res, resErr := server.Test(req)
+		if resErr != nil {
+			t.Fatal(resErr)
+		} else if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", res.StatusCode)
+		}
+
+		requests, _, listErr := buffman.NewSQLiteStore(db).ListRequests(ctx, buffman.ListOptions{})
+		if listErr != nil {
+			t.Fatal(listErr)
+		} else if len(requests) != 1 {
+			t.Fatalf("expected 1 queued request but got %d", len(requests))
+		}
+
+		queued := requests[0]
+		if queued.Method != http.MethodDelete || queued.Query != "id=7" || queued.ContentType != "text/plain" {
+			t.Errorf("unexpected queued request %+v", queued)
+		}
+	})
+
+	t.Run("StoresCompressedBodiesAsReceived", func(t *testing.T) {
+		server, db := createTestingServer(t)
+
+		compressed := bytes.Buffer{}
+		writer := gzip.NewWriter(&compressed)
+		writer.Write([]byte(`{ "x_id": 123 }`))
+		writer.Close()
+
+		path := fmt.Sprintf("/?token=%s", config.OdooSecret)
+
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(compressed.Bytes()))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+
+		res, resErr := server.Test(req)
+		if resErr != nil {
+			t.Fatal(resErr)
+		} else if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", res.StatusCode)
+		}
+
+		requests, _, listErr := buffman.NewSQLiteStore(db).ListRequests(ctx, buffman.ListOptions{})
+		if listErr != nil {
+			t.Fatal(listErr)
+		} else if len(requests) != 1 {
+			t.Fatalf("expected 1 queued request but got %d", len(requests))
+		}
+
+		queued := requests[0]
+		if !bytes.Equal(queued.Payload, compressed.Bytes()) || queued.ContentEncoding != "gzip" {
+			t.Errorf("expected the gzip body to be stored untouched but got %+v", queued)
+		}
+	})
+	t.Run("RateLimitedPerSourceIP", func(t *testing.T) {
+		config.IngestIPLimit = 2
+		config.IngestLimitWindow = time.Minute
+		t.Cleanup(func() { config.IngestIPLimit = 0 })
+
+		server, _ := createTestingServer(t)
+
+		path := fmt.Sprintf("/?token=%s", config.OdooSecret)
+
+		responses := []*http.Response{}
+		for range 3 {
+			res, resErr := server.Test(httptest.NewRequest(http.MethodPost, path, strings.NewReader("HelloWorld")))
+			if resErr != nil {
+				t.Fatal(resErr)
+			}
+			responses = append(responses, res)
+		}
+
+		if responses[1].StatusCode != http.StatusOK || responses[2].StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected the third request to be limited but got %d", responses[2].StatusCode)
+		}
+		if responses[1].Header.Get("X-RateLimit-Limit") != "2" || responses[1].Header.Get("X-RateLimit-Remaining") != "0" {
+			t.Errorf("expected rate limit headers but got %v", responses[1].Header)
+		}
+		if responses[2].Header.Get("Retry-After") == "" {
+			t.Errorf("expected a Retry-After header but got %v", responses[2].Header)
+		}
+	})
+
+	t.Run("RejectedWhenBacklogIsFull", func(t *testing.T) {
+		config.MaxBacklogSize = 1
+		config.BacklogFullPolicy = config.BacklogFullReject429
+		config.BacklogFullRetryAfter = time.Second * 30
+		t.Cleanup(func() {
+			config.MaxBacklogSize = 0
+			config.BacklogFullPolicy = ""
+			config.BacklogFullRetryAfter = 0
+		})
+
+		server, _ := createTestingServer(t)
+
+		path := fmt.Sprintf("/?token=%s", config.OdooSecret)
+
+		res, resErr := server.Test(httptest.NewRequest(http.MethodPost, path, strings.NewReader("first")))
+		if resErr != nil {
+			t.Fatal(resErr)
+		} else if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", res.StatusCode)
+		}
+
+		res, resErr = server.Test(httptest.NewRequest(http.MethodPost, path, strings.NewReader("second")))
+		if resErr != nil {
+			t.Fatal(resErr)
+		} else if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "30" {
+			t.Errorf("expected a 429 retrying after 30s but got %d %v", res.StatusCode, res.Header)
+		}
+	})
+	t.Run("ScopedApiKeys", func(t *testing.T) {
+		config.Destinations = []config.Destination{
+			{Name: "fma", URL: "https://fma/dispatch"},
+			{Name: "erp", URL: "https://erp/webhook"},
+		}
+		t.Cleanup(func() { config.Destinations = nil })
+
+		server, db := createTestingServer(t)
+		store := buffman.NewSQLiteStore(db)
+
+		key, secret, err := buffman.NewApiKey(ctx, store, "odoo", []string{"fma"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		queue := func(destination string, header, value string) int {
+			req := httptest.NewRequest(http.MethodPost, "/queue/"+destination, strings.NewReader("HelloWorld"))
+			req.Header.Set(header, value)
+
+			res, resErr := server.Test(req)
+			if resErr != nil {
+				t.Fatal(resErr)
+			}
+
+			return res.StatusCode
+		}
+
+		if status := queue("fma", "Authorization", "Bearer "+secret); status != http.StatusOK {
+			t.Errorf("expected status 200 with a bearer key but got %d", status)
+		}
+		if status := queue("fma", "X-Api-Key", secret); status != http.StatusOK {
+			t.Errorf("expected status 200 with an X-Api-Key header but got %d", status)
+		}
+		if status := queue("erp", "X-Api-Key", secret); status != http.StatusForbidden {
+			t.Errorf("expected status 403 outside of the key's destinations but got %d", status)
+		}
+		if status := queue("fma", "X-Api-Key", "bm_unknown"); status != http.StatusUnauthorized {
+			t.Errorf("expected status 401 with an unknown key but got %d", status)
+		}
+
+		requests, _, listErr := store.ListRequests(ctx, buffman.ListOptions{})
+		if listErr != nil {
+			t.Fatal(listErr)
+		} else if len(requests) != 2 || requests[0].ApiKey != "odoo" || requests[0].Headers.Get("Authorization") != "" {
+			t.Errorf("expected the requests to record the key name but got %+v", requests)
+		}
+
+		if revokeErr := store.RevokeApiKey(ctx, key.Id); revokeErr != nil {
+			t.Fatal(revokeErr)
+		}
+		if status := queue("fma", "X-Api-Key", secret); status != http.StatusUnauthorized {
+			t.Errorf("expected status 401 once the key is revoked but got %d", status)
+		}
+	})
 }
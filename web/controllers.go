@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/subtle"
-	"database/sql"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -18,28 +20,107 @@ func handleGetStatusRequest(ctx *fiber.Ctx) error {
 	return ctx.Status(200).Send([]byte("OK"))
 }
 
-func createQueueRequestHandler(ctx context.Context, db *sql.DB) func(*fiber.Ctx) error {
-	return func(c *fiber.Ctx) error {
-		token := c.Query("token")
-		hashedToken := sha256.Sum256([]byte(token))
-		hashedOdooSecret := sha256.Sum256([]byte(config.OdooSecret))
+// handleGetBreakersRequest reports the circuit breaker of every destination.
+func handleGetBreakersRequest(ctx *fiber.Ctx) error {
+	return ctx.Status(200).JSON(buffman.BreakerStates())
+}
+
+// apiKeyHeader carries API keys for callers that can't set Authorization.
+const apiKeyHeader = "X-Api-Key"
+
+// legacyApiKey stands for ODOO_SECRET passed as ?token=, which can queue for
+// every destination.
+var legacyApiKey = buffman.ApiKey{Name: "odoo-secret"}
+
+// presentedApiKey returns the API key sent as a Bearer token or in the
+// X-Api-Key header.
+func presentedApiKey(c *fiber.Ctx) string {
+	if key, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); found {
+		return key
+	}
+
+	return c.Get(apiKeyHeader)
+}
+
+// authenticateIngest finds the API key of an ingest request, falling back to
+// ODOO_SECRET in the token query parameter when no key was sent.
+// buffman.ErrNotFound is returned when neither matches.
+func authenticateIngest(ctx context.Context, c *fiber.Ctx, store buffman.Store) (buffman.ApiKey, error) {
+	if secret := presentedApiKey(c); secret != "" {
+		return buffman.AuthenticateApiKey(ctx, store, secret)
+	}
+
+	hashedToken := sha256.Sum256([]byte(c.Query("token")))
+	hashedOdooSecret := sha256.Sum256([]byte(config.OdooSecret))
+
+	if config.OdooSecret == "" || subtle.ConstantTimeCompare(hashedToken[:], hashedOdooSecret[:]) == 0 {
+		return buffman.ApiKey{}, buffman.ErrNotFound
+	}
+
+	return legacyApiKey, nil
+}
 
-		if subtle.ConstantTimeCompare(hashedToken[:], hashedOdooSecret[:]) == 0 {
+func createQueueRequestHandler(ctx context.Context, store buffman.Store) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		key, authErr := authenticateIngest(ctx, c, store)
+		if errors.Is(authErr, buffman.ErrNotFound) {
 			log.Println("received request with invalid secret")
 			return c.Status(http.StatusUnauthorized).Send([]byte("Unauthorized"))
+		} else if authErr != nil {
+			log.Println("error while authenticating request", authErr)
+			return c.Status(http.StatusInternalServerError).Send([]byte(""))
 		}
 
-		payload := string(c.Body())
+		destination := c.Params("destination", config.GetDefaultDestination())
+		if _, found := config.FindDestination(destination); !found {
+			return c.Status(http.StatusNotFound).Send([]byte("Unknown destination"))
+		}
 
-		if len(payload) == 0 {
-			return c.Status(http.StatusBadRequest).Send([]byte("Invalid body sent"))
+		if !key.Allows(destination) {
+			log.Printf("api key %s is not allowed to queue for %s", key.Name, destination)
+			return c.Status(http.StatusForbidden).Send([]byte("Forbidden"))
 		}
 
+		// the key is ours, it must not be replayed to the destination
+		headers := c.GetReqHeaders()
+		delete(headers, fiber.HeaderAuthorization)
+		delete(headers, apiKeyHeader)
+
+		// the body is stored as it was received, compressed bodies are
+		// replayed with their Content-Encoding instead of being decoded
+		payload := c.BodyRaw()
+
+		// the secret is ours, it must not be replayed to the destination
+		query := c.Request().URI().QueryArgs()
+		query.Del("token")
+
 		queueCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
 		defer cancel()
 
-		queueErr := buffman.QueueRequest(queueCtx, db, payload)
-		if queueErr != nil {
+		queueErr := buffman.QueueRequest(queueCtx, store, buffman.Inbound{
+			Destination:     destination,
+			Method:          c.Method(),
+			Payload:         payload,
+			Headers:         headers,
+			Query:           query.String(),
+			ContentType:     c.Get(fiber.HeaderContentType),
+			ContentEncoding: c.Get(fiber.HeaderContentEncoding),
+			ApiKey:          key.Name,
+		})
+		if errors.Is(queueErr, buffman.ErrDuplicateRequest) {
+			c.Set("Idempotent-Replayed", "true")
+			return c.Status(http.StatusOK).Send([]byte("OK"))
+		} else if errors.Is(queueErr, buffman.ErrBacklogFull) {
+			status := http.StatusServiceUnavailable
+			if config.BacklogFullPolicy == config.BacklogFullReject429 {
+				status = http.StatusTooManyRequests
+			}
+
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(config.BacklogFullRetryAfter.Seconds())))
+			return c.Status(status).Send([]byte("Backlog is full"))
+		} else if errors.Is(queueErr, buffman.ErrEmptyPayload) {
+			return c.Status(http.StatusBadRequest).Send([]byte("Invalid body sent"))
+		} else if queueErr != nil {
 			log.Println("Error while attempting to queue request", queueErr)
 			return c.Status(http.StatusInternalServerError).Send([]byte(""))
 		}
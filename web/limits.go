@@ -0,0 +1,53 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/mse99/buffman/config"
+)
+
+// ingestLimiters returns the rate limits put in front of the ingest endpoints,
+// per source IP and per API key or token. Both set the X-RateLimit-* headers and answer
+// 429 with a Retry-After header once the limit is reached.
+func ingestLimiters() []fiber.Handler {
+	limiters := []fiber.Handler{}
+
+	if config.IngestIPLimit > 0 {
+		limiters = append(limiters, limiter.New(limiter.Config{
+			Max:          config.IngestIPLimit,
+			Expiration:   config.IngestLimitWindow,
+			KeyGenerator: func(c *fiber.Ctx) string { return "ip:" + c.IP() },
+			LimitReached: limitReached,
+		}))
+	}
+
+	if config.IngestTokenLimit > 0 {
+		limiters = append(limiters, limiter.New(limiter.Config{
+			Max:        config.IngestTokenLimit,
+			Expiration: config.IngestLimitWindow,
+			// only a hash of the token is kept in memory
+			KeyGenerator: func(c *fiber.Ctx) string {
+				token := presentedApiKey(c)
+				if token == "" {
+					token = c.Query("token")
+				}
+
+				hashedToken := sha256.Sum256([]byte(token))
+				return "token:" + hex.EncodeToString(hashedToken[:])
+			},
+			LimitReached: limitReached,
+		}))
+	}
+
+	return limiters
+}
+
+func limitReached(c *fiber.Ctx) error {
+	log.Printf("rate limit reached for %s", c.IP())
+	return c.Status(http.StatusTooManyRequests).Send([]byte("Too many requests"))
+}
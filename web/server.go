@@ -2,22 +2,30 @@ package web
 
 import (
 	"context"
-	"database/sql"
 	"os"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/mse99/buffman/buffman"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func CreateServer(ctx context.Context, db *sql.DB) *fiber.App {
+func CreateServer(ctx context.Context, store buffman.Store) *fiber.App {
 	app := fiber.New()
-	setupRouter(ctx, app, db)
+	setupRouter(ctx, app, store)
 	return app
 }
 
-func setupRouter(ctx context.Context, app *fiber.App, db *sql.DB) {
+func setupRouter(ctx context.Context, app *fiber.App, store buffman.Store) {
 	app.Use(logger.New(logger.Config{Output: os.Stdout}))
 
 	app.Get("/status", handleGetStatusRequest)
-	app.Post("/", createQueueRequestHandler(ctx, db))
+	app.Get("/status/breakers", handleGetBreakersRequest)
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	ingest := append(ingestLimiters(), createQueueRequestHandler(ctx, store))
+	app.Post("/", ingest...)
+	app.All("/queue/:destination", ingest...)
+
+	setupAdminRouter(ctx, app, store)
 }